@@ -0,0 +1,151 @@
+// Package config loads the optional unbound_exporter configuration file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.yaml.in/yaml/v2"
+
+	"github.com/letsencrypt/unbound_exporter/exporter"
+)
+
+// DefaultProfile is the name of the TLS profile built from the -unbound.ca,
+// -unbound.cert and -unbound.key flags. It is used by /probe requests that do
+// not name a profile.
+const DefaultProfile = "default"
+
+// Config is the top-level structure of the configuration file.
+type Config struct {
+	// TLSProfiles are named sets of control channel credentials, selected by
+	// the profile parameter of /probe requests.
+	TLSProfiles map[string]TLSProfile `yaml:"tls_profiles"`
+
+	// Targets are the Unbound instances exported on the metrics path. If
+	// empty, the instance given by the -unbound.host flag is exported.
+	Targets []Target `yaml:"targets"`
+
+	// LabelLimits bound the values of labels driven by client traffic, such
+	// as the query type, by label name.
+	LabelLimits map[string]exporter.LabelLimit `yaml:"label_limits"`
+}
+
+// Target is an Unbound instance exported on the metrics path. Its metrics
+// carry a target label with the value of Host, plus any additional Labels.
+type Target struct {
+	Host   string            `yaml:"host"`
+	Labels map[string]string `yaml:"labels"`
+
+	// The control channel credentials are either given inline, or by
+	// naming one of the TLS profiles.
+	TLSProfile `yaml:",inline"`
+	Profile    string `yaml:"tls_profile"`
+}
+
+// TLSProfile names the files used to authenticate to Unbound's control
+// socket. Leaving all three empty selects a plaintext connection.
+type TLSProfile struct {
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// Load reads and validates the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.UnmarshalStrict(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if _, ok := cfg.TLSProfiles[DefaultProfile]; ok {
+		return nil, fmt.Errorf("tls profile name %q is reserved for the command line flags", DefaultProfile)
+	}
+
+	err = cfg.validateTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, limit := range cfg.LabelLimits {
+		if limit.Max < 0 {
+			return nil, fmt.Errorf("label limit %q: negative max", name)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// variableLabels are the label names of the exported metrics, which the
+// labels of targets must not repeat. Those added by a mapping file are
+// checked when the exporters are created.
+var variableLabels = exporter.LabelNames(nil)
+
+func (c *Config) validateTargets() error {
+	hosts := make(map[string]bool, len(c.Targets))
+	for _, t := range c.Targets {
+		if t.Host == "" {
+			return errors.New("target without host")
+		}
+		if hosts[t.Host] {
+			return fmt.Errorf("duplicate target %q", t.Host)
+		}
+		hosts[t.Host] = true
+
+		if t.Profile != "" {
+			if t.TLSProfile != (TLSProfile{}) {
+				return fmt.Errorf("target %q: tls_profile and inline credentials are mutually exclusive", t.Host)
+			}
+			if _, ok := c.TLSProfiles[t.Profile]; !ok && t.Profile != DefaultProfile {
+				return fmt.Errorf("target %q: unknown tls profile %q", t.Host, t.Profile)
+			}
+		}
+
+		for name := range t.Labels {
+			if !model.LegacyValidation.IsValidLabelName(name) || strings.HasPrefix(name, "__") {
+				return fmt.Errorf("target %q: invalid label name %q", t.Host, name)
+			}
+			if name == "target" || variableLabels[name] {
+				return fmt.Errorf("target %q: label name %q is reserved", t.Host, name)
+			}
+		}
+	}
+	return nil
+}
+
+// ConstLabels returns the constant labels for target t. Every target gets
+// the same set of label names, which Prometheus requires of metrics sharing
+// a name; labels missing from t are set to the empty string.
+func (c *Config) ConstLabels(t Target) prometheus.Labels {
+	labels := prometheus.Labels{"target": t.Host}
+	for _, other := range c.Targets {
+		for name := range other.Labels {
+			labels[name] = t.Labels[name]
+		}
+	}
+	return labels
+}
+
+// TLSCredentials loads the certificates of every profile, keyed by profile
+// name. Profiles without any files have nil credentials.
+func (c *Config) TLSCredentials(log *slog.Logger) (map[string]*exporter.TLSCredentials, error) {
+	creds := make(map[string]*exporter.TLSCredentials, len(c.TLSProfiles))
+	for name, p := range c.TLSProfiles {
+		cred, err := exporter.NewTLSCredentials(name, p.CA, p.Cert, p.Key, log)
+		if err != nil {
+			return nil, fmt.Errorf("tls profile %q: %w", name, err)
+		}
+		creds[name] = cred
+	}
+	return creds, nil
+}
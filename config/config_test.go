@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load("testdata/config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.TLSProfiles) != 2 {
+		t.Fatalf("expected 2 TLS profiles, got %d", len(cfg.TLSProfiles))
+	}
+	if cfg.TLSProfiles["edge"].Key != "/etc/unbound/edge/unbound_control.key" {
+		t.Errorf("unexpected key for edge profile: %q", cfg.TLSProfiles["edge"].Key)
+	}
+	if cfg.TLSProfiles["plaintext"] != (TLSProfile{}) {
+		t.Errorf("expected empty plaintext profile, got %+v", cfg.TLSProfiles["plaintext"])
+	}
+	if limit := cfg.LabelLimits["type"]; limit.Max != 10 || len(limit.Allow) != 3 || len(limit.Metrics) != 1 {
+		t.Errorf("unexpected label limit for type: %+v", limit)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, contents := range map[string]string{
+		"unknown field":    "tls_profile:\n  edge: {}\n",
+		"reserved profile": "tls_profiles:\n  default: {}\n",
+		"missing host":     "targets:\n  - labels: {a: b}\n",
+		"duplicate host":   "targets:\n  - host: unix:///a\n  - host: unix:///a\n",
+		"unknown profile":  "targets:\n  - host: unix:///a\n    tls_profile: edge\n",
+		"both credentials": "tls_profiles:\n  edge: {}\ntargets:\n  - host: tcp://a:1\n    tls_profile: edge\n    ca: /ca.pem\n",
+		"reserved label":   "targets:\n  - host: unix:///a\n    labels: {target: b}\n",
+		"invalid label":    "targets:\n  - host: unix:///a\n    labels: {a-b: c}\n",
+		"variable label":   "targets:\n  - host: unix:///a\n    labels: {thread: b}\n",
+		"negative limit":   "label_limits:\n  type: {max: -1}\n",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yml")
+		err := os.WriteFile(path, []byte(contents), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Load(path)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	cfg, err := Load("testdata/config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Targets) != 3 {
+		t.Fatalf("expected 3 targets, got %d", len(cfg.Targets))
+	}
+	if cfg.Targets[1].Profile != "edge" || cfg.Targets[2].CA != "/etc/unbound/internal/unbound_server.pem" {
+		t.Errorf("unexpected target credentials: %+v", cfg.Targets)
+	}
+
+	expected := prometheus.Labels{
+		"target":        "tcp://127.0.0.1:8954",
+		"instance_role": "",
+		"view":          "internal",
+	}
+	labels := cfg.ConstLabels(cfg.Targets[2])
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+}
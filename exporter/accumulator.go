@@ -0,0 +1,249 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// bootTolerance is how far apart two computations of Unbound's start time,
+// time.now - time.up, may be while still referring to the same process.
+const bootTolerance = 10.0
+
+// resetSignalPattern matches the statistics that only go backwards when the
+// counters are reset: the number of queries, and time.elapsed, the time since
+// the last reset.
+var resetSignalPattern = regexp.MustCompile(`^(?:time\.elapsed|(?:total|thread\d+)\.num\.queries)$`)
+
+func resetSignal(key string) bool {
+	// The suffix spares other keys the regular expression.
+	return (key == "time.elapsed" || strings.HasSuffix(key, ".num.queries")) && resetSignalPattern.MatchString(key)
+}
+
+// accumulatorState is what an accumulator knows about one Unbound process.
+type accumulatorState struct {
+	// Boot is the start time of the Unbound process, in seconds since 1970.
+	Boot float64 `json:"boot"`
+	// Up is the uptime reported by the last snapshot.
+	Up float64 `json:"up"`
+	// Last holds the raw values of the counters and reset signals of the
+	// last snapshot.
+	Last map[string]float64 `json:"last"`
+	// Offsets are added to the raw counter values, and hold the sum of
+	// their values before each reset.
+	Offsets map[string]float64 `json:"offsets"`
+	// Resets is the number of counter resets detected.
+	Resets float64 `json:"resets"`
+}
+
+// accumulator keeps monotonic running totals of Unbound's counters, which
+// `unbound-control stats` resets to zero behind the exporter's back.
+//
+// A reset is detected when the number of queries or time.elapsed goes
+// backwards although time.up kept increasing. All counters are reset at once,
+// so the last values seen of all of them are then added to their offsets.
+// Times are left alone: time.up is not reset, and time.elapsed is expected
+// to start over. When Unbound itself restarts, the
+// offsets are dropped, as Prometheus handles that reset like any other.
+type accumulator struct {
+	key   string
+	store *CounterStore
+
+	mu    sync.Mutex
+	state *accumulatorState
+}
+
+func newAccumulator(key string, store *CounterStore) *accumulator {
+	a := &accumulator{key: key, store: store}
+	if store != nil {
+		a.state = store.load(key)
+	}
+	return a
+}
+
+// apply returns stats with the values of counters replaced by their running
+// totals, including the counters missing from stats since a reset.
+// isCounter tells which keys are counters.
+func (a *accumulator) apply(stats []stat, isCounter func(key string) bool) ([]stat, error) {
+	var now, up float64
+	var haveNow, haveUp bool
+	for _, s := range stats {
+		switch s.key {
+		case "time.now":
+			now, haveNow = s.value, true
+		case "time.up":
+			up, haveUp = s.value, true
+		}
+	}
+	if !haveNow || !haveUp {
+		// Without uptime, resets cannot be told from restarts.
+		return stats, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	boot := now - up
+	prev := a.state
+	if prev == nil || up < prev.Up || math.Abs(boot-prev.Boot) > bootTolerance {
+		var resets float64
+		if prev != nil {
+			resets = prev.Resets
+		}
+		prev = &accumulatorState{
+			Last:    map[string]float64{},
+			Offsets: map[string]float64{},
+			Resets:  resets,
+		}
+	}
+
+	next := &accumulatorState{
+		Boot:    boot,
+		Up:      up,
+		Last:    make(map[string]float64, len(prev.Last)),
+		Offsets: prev.Offsets,
+		Resets:  prev.Resets,
+	}
+	reset := false
+	counters := make([]bool, len(stats))
+	for i, s := range stats {
+		counters[i] = accumulates(s.key, isCounter)
+		signal := resetSignal(s.key)
+		if last, ok := prev.Last[s.key]; ok && s.value < last && signal {
+			reset = true
+		}
+		if counters[i] || signal {
+			next.Last[s.key] = s.value
+		}
+	}
+	if reset {
+		next.Resets++
+		next.Offsets = make(map[string]float64, len(prev.Offsets))
+		for key, offset := range prev.Offsets {
+			next.Offsets[key] = offset
+		}
+		for key, last := range prev.Last {
+			if accumulates(key, isCounter) {
+				next.Offsets[key] += last
+			}
+		}
+	}
+	// Keep the last value of counters missing from this snapshot, so that
+	// they are still compensated for if they reappear after a reset.
+	for key, last := range prev.Last {
+		if _, ok := next.Last[key]; !ok && !reset {
+			next.Last[key] = last
+		}
+	}
+	a.state = next
+
+	adjusted := make([]stat, len(stats), len(stats)+len(next.Offsets))
+	present := make(map[string]bool, len(stats))
+	for i, s := range stats {
+		if offset, ok := next.Offsets[s.key]; ok && counters[i] {
+			s.value += offset
+		}
+		adjusted[i] = s
+		present[s.key] = true
+	}
+	// After a reset, Unbound leaves out counters until it counts them
+	// again, such as num.query.type.MX. Their totals are still exported,
+	// rather than dropping, or going to zero with -metrics.zero-fill.
+	for _, key := range slices.Sorted(maps.Keys(next.Offsets)) {
+		if !present[key] {
+			adjusted = append(adjusted, stat{key, next.Offsets[key]})
+		}
+	}
+
+	if a.store != nil {
+		return adjusted, a.store.save(a.key, next)
+	}
+	return adjusted, nil
+}
+
+// accumulates tells whether key is a counter whose running total is kept.
+func accumulates(key string, isCounter func(key string) bool) bool {
+	return !strings.HasPrefix(key, "time.") && isCounter(key)
+}
+
+// resets returns the number of counter resets detected so far.
+func (a *accumulator) resets() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state == nil {
+		return 0
+	}
+	return a.state.Resets
+}
+
+// CounterStore persists the running totals of counters in a file, so that
+// they survive restarts of the exporter. One store can be shared by the
+// exporters of several Unbound instances.
+type CounterStore struct {
+	path string
+
+	mu     sync.Mutex
+	states map[string]*accumulatorState
+}
+
+// NewCounterStore returns a store persisting to path, loading the totals
+// from it if it exists.
+func NewCounterStore(path string) (*CounterStore, error) {
+	s := &CounterStore{
+		path:   path,
+		states: map[string]*accumulatorState{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.states)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *CounterStore) load(key string) *accumulatorState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[key]
+}
+
+// save records the state for key and rewrites the file. The file is
+// replaced atomically, so that a crash cannot leave it truncated.
+func (s *CounterStore) save(key string, state *accumulatorState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[key] = state
+
+	data, err := json.Marshal(s.states)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,174 @@
+package exporter
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+// dump builds the statistics of an Unbound started at time 1000, with the
+// given uptime and value of its only counter.
+func dump(up, queries float64) []stat {
+	return []stat{
+		{"time.now", 1000 + up},
+		{"time.up", up},
+		{"thread0.num.queries", queries},
+		{"mem.cache.rrset", 5},
+	}
+}
+
+func value(stats []stat, key string) float64 {
+	for _, s := range stats {
+		if s.key == key {
+			return s.value
+		}
+	}
+	return -1
+}
+
+func TestAccumulator(t *testing.T) {
+	metrics := compileMetrics(unboundMetrics, nil)
+	a := newAccumulator("unix:///run/unbound.ctl", nil)
+
+	for i, step := range []struct {
+		up, queries float64
+		expected    float64
+		resets      float64
+	}{
+		{10, 5, 5, 0},
+		{20, 8, 8, 0},
+		// unbound-control stats reset the counter
+		{30, 2, 10, 1},
+		{40, 4, 12, 1},
+		// Unbound restarted, so the reset is left to Prometheus
+		{5, 1, 1, 1},
+	} {
+		stats, err := a.apply(dump(step.up, step.queries), metrics.isCounter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := value(stats, "thread0.num.queries"); v != step.expected {
+			t.Errorf("step %d: expected queries %v, got %v", i, step.expected, v)
+		}
+		if v := value(stats, "mem.cache.rrset"); v != 5 {
+			t.Errorf("step %d: gauge was changed to %v", i, v)
+		}
+		if r := a.resets(); r != step.resets {
+			t.Errorf("step %d: expected %v resets, got %v", i, step.resets, r)
+		}
+	}
+}
+
+func TestCounterStore(t *testing.T) {
+	metrics := compileMetrics(unboundMetrics, nil)
+	path := filepath.Join(t.TempDir(), "counters.json")
+
+	store, err := NewCounterStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAccumulator("unix:///run/unbound.ctl", store)
+	for _, d := range [][]stat{dump(10, 5), dump(20, 1)} {
+		_, err = a.apply(d, metrics.isCounter)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// After a restart of the exporter, a reset that happened while it was
+	// down is still detected.
+	store, err = NewCounterStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = newAccumulator("unix:///run/unbound.ctl", store)
+	stats, err := a.apply(dump(30, 0), metrics.isCounter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := value(stats, "thread0.num.queries"); v != 6 {
+		t.Errorf("expected queries 6, got %v", v)
+	}
+	if r := a.resets(); r != 2 {
+		t.Errorf("expected 2 resets, got %v", r)
+	}
+}
+
+func TestAccumulatorGauges(t *testing.T) {
+	// In v1, infra_cache_count is exported as a counter, although the
+	// infra cache shrinks without any reset.
+	metrics := compileMetrics(namingTable(unboundMetrics, NamingV1), nil)
+	a := newAccumulator("unix:///run/unbound.ctl", nil)
+
+	for i, step := range []struct {
+		up, elapsed, queries, infra float64
+		expected                    float64
+		resets                      float64
+	}{
+		{10, 10, 100, 50, 100, 0},
+		{20, 20, 110, 30, 110, 0},
+		// unbound-control stats reset the counters and time.elapsed
+		{30, 5, 4, 40, 114, 1},
+	} {
+		stats, err := a.apply([]stat{
+			{"time.now", 1000 + step.up},
+			{"time.up", step.up},
+			{"time.elapsed", step.elapsed},
+			{"thread0.num.queries", step.queries},
+			{"infra.cache.count", step.infra},
+		}, metrics.isCounter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := value(stats, "thread0.num.queries"); v != step.expected {
+			t.Errorf("step %d: expected queries %v, got %v", i, step.expected, v)
+		}
+		if v := value(stats, "infra.cache.count"); v != step.infra {
+			t.Errorf("step %d: infra cache count was changed to %v", i, v)
+		}
+		if v := value(stats, "time.up"); v != step.up {
+			t.Errorf("step %d: uptime was changed to %v", i, v)
+		}
+		if v := value(stats, "time.elapsed"); v != step.elapsed {
+			t.Errorf("step %d: elapsed time was changed to %v", i, v)
+		}
+		if r := a.resets(); r != step.resets {
+			t.Errorf("step %d: expected %v resets, got %v", i, step.resets, r)
+		}
+	}
+}
+
+func TestAccumulatorZeroFill(t *testing.T) {
+	var reply atomic.Value
+	reply.Store("time.now=1010\ntime.up=10\ntotal.num.queries=10\nnum.query.type.A=5\nnum.query.type.MX=5\n")
+	target := unboundtest.Listen(t, unboundtest.Serve(t, func(string) (string, bool) {
+		return reply.Load().(string), true
+	}))
+	exp, err := NewUnboundExporter(target, Options{AccumulateCounters: true, ZeroFill: true}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := func() map[string]float64 {
+		t.Helper()
+		types := map[string]float64{}
+		for _, m := range gather(t, exp)["unbound_query_types_total"].GetMetric() {
+			types[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+		return types
+	}
+	if v := types()["MX"]; v != 5 {
+		t.Fatalf("expected 5 MX queries, got %v", v)
+	}
+
+	// unbound-control stats reset the counters, and Unbound leaves out MX
+	// until it counts one again, so it must not be zero filled.
+	reply.Store("time.now=1020\ntime.up=20\ntotal.num.queries=1\nnum.query.type.A=1\n")
+	got := types()
+	if got["MX"] != 5 || got["A"] != 6 || got["AAAA"] != 0 {
+		t.Errorf("unexpected query types after the reset: %v", got)
+	}
+}
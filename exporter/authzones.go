@@ -0,0 +1,160 @@
+package exporter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authZonesCommand exports the status of the zones Unbound serves or
+// transfers with auth-zone, from the list_auth_zones command.
+type authZonesCommand struct {
+	serial    *prometheus.Desc
+	expired   *prometheus.Desc
+	serialAge *prometheus.Desc
+
+	// now returns the current time, and is replaced in tests.
+	now func() time.Time
+
+	mu sync.Mutex
+	// serials holds the last serial of each zone and when it was first
+	// seen, to tell how long ago it changed.
+	serials map[string]serialChange
+}
+
+type serialChange struct {
+	serial uint32
+	seen   time.Time
+}
+
+func newAuthZonesCommand(constLabels prometheus.Labels) *authZonesCommand {
+	return &authZonesCommand{
+		serial: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "auth_zone", "serial"),
+			"SOA serial of the auth zone, if it has one.",
+			[]string{"zone"}, constLabels),
+		expired: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "auth_zone", "expired"),
+			"Whether the auth zone expired, for lack of successful transfers.",
+			[]string{"zone"}, constLabels),
+		serialAge: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "auth_zone", "serial_age_seconds"),
+			"Time since the exporter saw the serial of the auth zone change, or first saw it, in seconds.",
+			[]string{"zone"}, constLabels),
+		now:     time.Now,
+		serials: map[string]serialChange{},
+	}
+}
+
+func (c *authZonesCommand) command() string {
+	return "list_auth_zones"
+}
+
+func (c *authZonesCommand) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.serial
+	ch <- c.expired
+	ch <- c.serialAge
+}
+
+// authZone is a line of list_auth_zones, one of:
+//
+//	example.org.	serial 2024010101
+//	example.org.	expired
+//	example.org.	no serial
+type authZone struct {
+	name      string
+	expired   bool
+	hasSerial bool
+	serial    uint32
+	// changed is when the serial was first seen.
+	changed time.Time
+}
+
+func parseAuthZone(line string) (authZone, error) {
+	name, status, ok := strings.Cut(line, "\t")
+	if !ok {
+		return authZone{}, fmt.Errorf("%q: not an auth zone", line)
+	}
+	zone := authZone{name: name}
+	switch {
+	case status == "expired":
+		zone.expired = true
+	case status == "no serial":
+	case strings.HasPrefix(status, "serial "):
+		serial, err := strconv.ParseUint(strings.TrimPrefix(status, "serial "), 10, 32)
+		if err != nil {
+			return authZone{}, fmt.Errorf("%q: %w", line, err)
+		}
+		zone.hasSerial = true
+		zone.serial = uint32(serial)
+	default:
+		return authZone{}, fmt.Errorf("%q: unknown zone status", line)
+	}
+	return zone, nil
+}
+
+func (c *authZonesCommand) parse(r io.Reader) (commandReply, error) {
+	var zones []authZone
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "error ") {
+			return nil, &scrapeError{reasonUnbound, errors.New(line)}
+		}
+		zone, err := parseAuthZone(line)
+		if err != nil {
+			return nil, &scrapeError{reasonParse, err}
+		}
+		zones = append(zones, zone)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &scrapeError{reasonRead, err}
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	serials := make(map[string]serialChange, len(zones))
+	for i, zone := range zones {
+		if !zone.hasSerial {
+			continue
+		}
+		last, ok := c.serials[zone.name]
+		if !ok || last.serial != zone.serial {
+			last = serialChange{zone.serial, now}
+		}
+		serials[zone.name] = last
+		zones[i].changed = last.seen
+	}
+	// Zones that are gone, or lost their serial, start over.
+	c.serials = serials
+	return &authZonesReply{c, zones}, nil
+}
+
+type authZonesReply struct {
+	cmd   *authZonesCommand
+	zones []authZone
+}
+
+func (r *authZonesReply) collect(ch chan<- prometheus.Metric) {
+	now := r.cmd.now()
+	for _, zone := range r.zones {
+		expired := 0.0
+		if zone.expired {
+			expired = 1
+		}
+		ch <- prometheus.MustNewConstMetric(r.cmd.expired, prometheus.GaugeValue, expired, zone.name)
+		if !zone.hasSerial {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(r.cmd.serial, prometheus.GaugeValue, float64(zone.serial), zone.name)
+		ch <- prometheus.MustNewConstMetric(r.cmd.serialAge, prometheus.GaugeValue, now.Sub(zone.changed).Seconds(), zone.name)
+	}
+}
@@ -0,0 +1,79 @@
+package exporter
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestParseAuthZone(t *testing.T) {
+	for line, want := range map[string]authZone{
+		"example.org.\tserial 2024010101": {name: "example.org.", hasSerial: true, serial: 2024010101},
+		"example.com.\texpired":           {name: "example.com.", expired: true},
+		".\tno serial":                    {name: "."},
+	} {
+		zone, err := parseAuthZone(line)
+		if err != nil {
+			t.Errorf("%q: %s", line, err)
+		} else if zone != want {
+			t.Errorf("%q: got %+v, expected %+v", line, zone, want)
+		}
+	}
+
+	for _, line := range []string{
+		"example.org.",
+		"example.org.\tserial x",
+		"example.org.\tserial 4294967296",
+		"example.org.\tstale",
+	} {
+		if _, err := parseAuthZone(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestAuthZones(t *testing.T) {
+	var zones atomic.Value
+	zones.Store("example.org.\tserial 1\nexample.com.\texpired\n")
+	target := unboundtest.Listen(t, unboundtest.Serve(t, func(command string) (string, bool) {
+		return zones.Load().(string), command == "list_auth_zones"
+	}))
+	exp, err := NewUnboundExporter(target, Options{AuthZones: true}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exp.commands[0].(*authZonesCommand)
+	now := time.Unix(1000, 0)
+	cmd.now = func() time.Time { return now }
+
+	zoneValues := func(name string) map[string]float64 {
+		t.Helper()
+		values := map[string]float64{}
+		for _, m := range gather(t, exp)[name].GetMetric() {
+			values[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		return values
+	}
+
+	if serials := zoneValues("unbound_auth_zone_serial"); len(serials) != 1 || serials["example.org."] != 1 {
+		t.Errorf("unexpected serials %v", serials)
+	}
+	if expired := zoneValues("unbound_auth_zone_expired"); len(expired) != 2 || expired["example.org."] != 0 || expired["example.com."] != 1 {
+		t.Errorf("unexpected expired zones %v", expired)
+	}
+
+	// The age grows while the serial stays the same, and starts over when
+	// it changes.
+	now = now.Add(time.Minute)
+	if age := zoneValues("unbound_auth_zone_serial_age_seconds")["example.org."]; age != 60 {
+		t.Errorf("expected an age of 60s, got %v", age)
+	}
+	zones.Store("example.org.\tserial 2\n")
+	now = now.Add(time.Minute)
+	if age := zoneValues("unbound_auth_zone_serial_age_seconds")["example.org."]; age != 0 {
+		t.Errorf("expected an age of 0s after the serial changed, got %v", age)
+	}
+}
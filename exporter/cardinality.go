@@ -0,0 +1,232 @@
+package exporter
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherValue is the label value that values beyond a LabelLimit are folded
+// into.
+const otherValue = "other"
+
+// LabelLimit bounds the values of a label driven by client traffic, such as
+// the type label of unbound_query_types_total.
+type LabelLimit struct {
+	// Max is the number of values kept besides those in Allow. The values
+	// with the highest counts are kept, and once kept they stay for the
+	// lifetime of the exporter, so that counters remain monotonic. The
+	// offenders of the rate limits, which are gauges, are instead chosen
+	// anew on each scrape.
+	Max int `yaml:"max"`
+	// Allow lists values that are always kept.
+	Allow []string `yaml:"allow"`
+	// Metrics restricts the limit to the metrics with these names. If
+	// empty, it applies to every metric with the label, such as both
+	// unbound_query_types_total and unbound_rpz_action_count for type.
+	Metrics []string `yaml:"metrics"`
+}
+
+// applies reports whether the limit applies to a metric exported under any
+// of names.
+func (l LabelLimit) applies(names ...string) bool {
+	if len(l.Metrics) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if slices.Contains(l.Metrics, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// codeLabels maps the labels holding DNS codes to the mnemonics Unbound
+// uses and the prefix it puts before codes without one, as in TYPE65280.
+var codeLabels = map[string]struct {
+	names  map[int]string
+	prefix string
+}{
+	"type":   {qtypeNames, "TYPE"},
+	"class":  {qclassNames, "CLASS"},
+	"opcode": {opcodeNames, "OPCODE"},
+	"rcode":  {rcodeNames, "RCODE"},
+}
+
+var numericCode = regexp.MustCompile(`^([A-Z]+)(\d+)$`)
+
+// translateLabels replaces, in place, numeric DNS codes printed by an
+// Unbound that does not know their mnemonic, such as TYPE65 for HTTPS, with
+// the mnemonic. It is only used for metrics with label limits or values to
+// zero-fill, which name values by their mnemonic.
+func translateLabels(names, values []string) {
+	for i, name := range names {
+		code, ok := codeLabels[name]
+		if !ok {
+			continue
+		}
+		matches := numericCode.FindStringSubmatch(values[i])
+		if matches == nil || matches[1] != code.prefix {
+			continue
+		}
+		n, err := strconv.Atoi(matches[2])
+		if err != nil {
+			continue
+		}
+		values[i] = codeName(code.names, code.prefix, n)
+	}
+}
+
+// labelGuard applies a LabelLimit to the values of a label, in every metric
+// that has it and that the limit applies to.
+type labelGuard struct {
+	limit LabelLimit
+	allow map[string]bool
+
+	mu sync.Mutex
+	// kept holds the values kept beyond the allowed ones, by metric index.
+	kept map[int]map[string]bool
+}
+
+func newLabelGuard(limit LabelLimit) *labelGuard {
+	g := &labelGuard{
+		limit: limit,
+		allow: make(map[string]bool, len(limit.Allow)),
+		kept:  map[int]map[string]bool{},
+	}
+	for _, value := range limit.Allow {
+		g.allow[value] = true
+	}
+	return g
+}
+
+// sample is a value of a metric, with its label values.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// fold replaces the values of the label at pos in samples of the metric at
+// index i that the limit does not keep with otherValue. It returns the
+// number of distinct values folded.
+func (g *labelGuard) fold(i, pos int, samples []sample) int {
+	counts := map[string]float64{}
+	for _, s := range samples {
+		counts[s.labels[pos]] += s.value
+	}
+
+	g.mu.Lock()
+	kept := g.kept[i]
+	if kept == nil {
+		kept = map[string]bool{}
+		g.kept[i] = kept
+	}
+	var candidates []string
+	for value := range counts {
+		if !g.allow[value] && !kept[value] {
+			candidates = append(candidates, value)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), strings.Compare(a, b))
+	})
+	for len(kept) < g.limit.Max && len(candidates) > 0 {
+		kept[candidates[0]] = true
+		candidates = candidates[1:]
+	}
+	g.mu.Unlock()
+
+	if len(candidates) == 0 {
+		return 0
+	}
+	folded := make(map[string]bool, len(candidates))
+	for _, value := range candidates {
+		folded[value] = true
+	}
+	for j, s := range samples {
+		if folded[s.labels[pos]] {
+			labels := slices.Clone(s.labels)
+			labels[pos] = otherValue
+			samples[j].labels = labels
+		}
+	}
+	return len(candidates)
+}
+
+// guard returns the guard of label in metric, or nil if no limit applies.
+func (m *metricSet) guard(metric unboundMetric, label string) *labelGuard {
+	g := m.guards[label]
+	if g == nil || !g.limit.applies(metric.names()...) {
+		return nil
+	}
+	return g
+}
+
+// keeps reports whether the value is kept for the metric at index i.
+func (g *labelGuard) keeps(i int, value string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.allow[value] || g.kept[i][value]
+}
+
+// collectGuarded applies the label limits to the pending samples of guarded
+// metrics, keyed by metric index, and sends them. The values in zeros are
+// sent as zero if the limits keep them, but are not counted towards them.
+func (m *metricSet) collectGuarded(pending map[int][]sample, zeros map[int][]string, ch chan<- prometheus.Metric) {
+	indices := make([]int, 0, len(pending))
+	for i := range pending {
+		indices = append(indices, i)
+	}
+	for i := range zeros {
+		if pending[i] == nil {
+			indices = append(indices, i)
+		}
+	}
+	slices.Sort(indices)
+
+	for _, i := range indices {
+		metric := m.metrics[i]
+		samples := pending[i]
+		for pos, name := range metric.labels {
+			guard := m.guard(metric, name)
+			if guard == nil {
+				continue
+			}
+			folded := guard.fold(i, pos, samples)
+			ch <- prometheus.MustNewConstMetric(
+				m.foldedValues,
+				prometheus.GaugeValue,
+				float64(folded),
+				metric.name, name)
+		}
+
+		// Folding merges samples, whose values are then summed.
+		var merged []sample
+		index := map[string]int{}
+		for _, s := range samples {
+			key := strings.Join(s.labels, "\xff")
+			if j, ok := index[key]; ok {
+				merged[j].value += s.value
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, s)
+		}
+		for _, s := range merged {
+			metric.send(ch, s.value, s.labels...)
+		}
+
+		// Zero-filled metrics have a single label.
+		guard := m.guard(metric, metric.labels[0])
+		for _, value := range zeros[i] {
+			if guard == nil || guard.keeps(i, value) {
+				metric.send(ch, 0, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestTranslateLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name, value, expected string
+	}{
+		{"type", "TYPE65", "HTTPS"},
+		{"type", "TYPE65280", "TYPE65280"},
+		{"type", "AAAA", "AAAA"},
+		{"class", "CLASS3", "CH"},
+		{"rcode", "RCODE9", "NOTAUTH"},
+		{"opcode", "OPCODE4", "NOTIFY"},
+		{"type", "CLASS3", "CLASS3"},
+		{"thread", "TYPE65", "TYPE65"},
+	} {
+		values := []string{tc.value}
+		translateLabels([]string{tc.name}, values)
+		if values[0] != tc.expected {
+			t.Errorf("%s=%s: expected %s, got %s", tc.name, tc.value, tc.expected, values[0])
+		}
+	}
+}
+
+func TestLabelLimits(t *testing.T) {
+	var https atomic.Int64
+	https.Store(7)
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 64))
+		_, _ = fmt.Fprintf(conn, "num.query.type.A=10\nnum.query.type.AAAA=8\nnum.query.type.MX=5\n"+
+			"num.query.type.TXT=3\nnum.query.type.TYPE65=%d\nnum.query.type.TYPE65280=1\n", https.Load())
+	})
+	opts := Options{LabelLimits: map[string]LabelLimit{"type": {Max: 1, Allow: []string{"AAAA"}}}}
+	exp, err := NewUnboundExporter(target, opts, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(expected map[string]float64, folded float64) {
+		t.Helper()
+		families := gather(t, exp)
+		types := map[string]float64{}
+		for _, m := range families["unbound_query_types_total"].GetMetric() {
+			types[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+		if fmt.Sprint(types) != fmt.Sprint(expected) {
+			t.Errorf("expected %v, got %v", expected, types)
+		}
+		metrics := families["unbound_exporter_folded_label_values"].GetMetric()
+		if len(metrics) != 1 || metrics[0].GetGauge().GetValue() != folded {
+			t.Errorf("expected %v folded values, got %v", folded, metrics)
+		}
+	}
+
+	// AAAA is allowed, A has the highest count, and the rest, HTTPS
+	// included, is folded.
+	check(map[string]float64{"A": 10, "AAAA": 8, "other": 16}, 4)
+
+	// A keeps its place although HTTPS overtook it.
+	https.Store(100)
+	check(map[string]float64{"A": 10, "AAAA": 8, "other": 109}, 4)
+
+	_, err = NewUnboundExporter(target, Options{LabelLimits: map[string]LabelLimit{"type": {Max: -1}}}, promslog.NewNopLogger())
+	if err == nil {
+		t.Error("negative limit accepted")
+	}
+}
+
+func TestLabelLimitMetrics(t *testing.T) {
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 64))
+		_, _ = conn.Write([]byte("num.query.type.A=10\nnum.query.type.TYPE65=7\n" +
+			"num.rpz.action.rpz-nxdomain=3\nnum.rpz.action.rpz-drop=2\n"))
+	})
+	values := func(limits map[string]LabelLimit, name string) map[string]float64 {
+		t.Helper()
+		exp, err := NewUnboundExporter(target, Options{LabelLimits: limits}, promslog.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]float64{}
+		for _, m := range gather(t, exp)[name].GetMetric() {
+			values[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+		return values
+	}
+
+	// Without limits, labels are exported as Unbound prints them.
+	if types := values(nil, "unbound_query_types_total"); fmt.Sprint(types) != "map[A:10 TYPE65:7]" {
+		t.Errorf("unexpected query types without limits: %v", types)
+	}
+
+	// A limit on type applies to every metric with the label, unless it
+	// names the metrics.
+	limit := LabelLimit{Max: 1}
+	if actions := values(map[string]LabelLimit{"type": limit}, "unbound_rpz_action_count"); fmt.Sprint(actions) != "map[nxdomain:3 other:2]" {
+		t.Errorf("unexpected rpz actions with a limit on type: %v", actions)
+	}
+	limit.Metrics = []string{"unbound_query_types_total"}
+	limits := map[string]LabelLimit{"type": limit}
+	if actions := values(limits, "unbound_rpz_action_count"); fmt.Sprint(actions) != "map[drop:2 nxdomain:3]" {
+		t.Errorf("unexpected rpz actions with a limit on query types: %v", actions)
+	}
+	if types := values(limits, "unbound_query_types_total"); fmt.Sprint(types) != "map[A:10 other:7]" {
+		t.Errorf("unexpected query types with a limit on them: %v", types)
+	}
+
+	limit.Metrics = []string{"unbound_query_type"}
+	_, err := NewUnboundExporter(target, Options{LabelLimits: map[string]LabelLimit{"type": limit}}, promslog.NewNopLogger())
+	if err == nil {
+		t.Error("limit for an unknown metric accepted")
+	}
+}
@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"context"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// controlCommand is an optional control command run after the statistics
+// on each round trip, such as status or dump_infra, each on a connection of
+// its own.
+type controlCommand interface {
+	// command is the name of the command, as sent to Unbound.
+	command() string
+	describe(ch chan<- *prometheus.Desc)
+	// parse reads the reply to the command.
+	parse(r io.Reader) (commandReply, error)
+}
+
+// commandReply is the parsed reply to a control command.
+type commandReply interface {
+	collect(ch chan<- prometheus.Metric)
+}
+
+// runCommand sends cmd to Unbound and parses the reply.
+func (e *UnboundExporter) runCommand(ctx context.Context, cmd controlCommand) (commandReply, error) {
+	conn, err := e.dial(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("UBCT1 " + cmd.command() + "\n"))
+	if err != nil {
+		return nil, &scrapeError{reasonRead, err}
+	}
+	return cmd.parse(conn)
+}
+
+// runCommands runs the control commands of the exporter. The commands only
+// add to the statistics, so their failures do not fail the round trip, and
+// are only logged the first time after a success: Unbound refuses some of
+// them, for instance, when control-use-cert restrictions apply.
+func (e *UnboundExporter) runCommands(ctx context.Context) []commandReply {
+	if e.socketFamily == "shm" {
+		return nil
+	}
+	var replies []commandReply
+	for _, cmd := range e.commands {
+		reply, err := e.runCommand(ctx, cmd)
+		if err != nil {
+			e.mu.Lock()
+			logged := e.commandFailed[cmd.command()]
+			e.commandFailed[cmd.command()] = true
+			e.mu.Unlock()
+			if !logged {
+				e.log.Warn("Control command failed, leaving out its metrics", "command", cmd.command(), "reason", failureReason(ctx, err), "err", err.Error())
+			}
+			continue
+		}
+		e.mu.Lock()
+		recovered := e.commandFailed[cmd.command()]
+		delete(e.commandFailed, cmd.command())
+		e.mu.Unlock()
+		if recovered {
+			e.log.Info("Control command succeeded again", "command", cmd.command())
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
@@ -0,0 +1,51 @@
+package exporter
+
+import "fmt"
+
+// The mnemonics Unbound uses for DNS codes in its statistics keys, as in
+// num.query.type.AAAA. Codes without a mnemonic are printed as TYPE65280,
+// CLASS7 and so on.
+var (
+	qtypeNames = map[int]string{
+		1: "A", 2: "NS", 3: "MD", 4: "MF", 5: "CNAME", 6: "SOA", 7: "MB",
+		8: "MG", 9: "MR", 10: "NULL", 11: "WKS", 12: "PTR", 13: "HINFO",
+		14: "MINFO", 15: "MX", 16: "TXT", 17: "RP", 18: "AFSDB", 19: "X25",
+		20: "ISDN", 21: "RT", 22: "NSAP", 23: "NSAP-PTR", 24: "SIG",
+		25: "KEY", 26: "PX", 27: "GPOS", 28: "AAAA", 29: "LOC", 30: "NXT",
+		31: "EID", 32: "NIMLOC", 33: "SRV", 34: "ATMA", 35: "NAPTR",
+		36: "KX", 37: "CERT", 38: "A6", 39: "DNAME", 40: "SINK", 41: "OPT",
+		42: "APL", 43: "DS", 44: "SSHFP", 45: "IPSECKEY", 46: "RRSIG",
+		47: "NSEC", 48: "DNSKEY", 49: "DHCID", 50: "NSEC3",
+		51: "NSEC3PARAM", 52: "TLSA", 53: "SMIMEA", 55: "HIP", 56: "NINFO",
+		57: "RKEY", 58: "TALINK", 59: "CDS", 60: "CDNSKEY",
+		61: "OPENPGPKEY", 62: "CSYNC", 63: "ZONEMD", 64: "SVCB",
+		65: "HTTPS", 66: "DSYNC", 99: "SPF", 104: "NID", 105: "L32",
+		106: "L64", 107: "LP", 108: "EUI48", 109: "EUI64", 128: "NXNAME",
+		249: "TKEY", 250: "TSIG", 251: "IXFR", 252: "AXFR", 253: "MAILB",
+		254: "MAILA", 255: "ANY", 256: "URI", 257: "CAA", 258: "AVC",
+		260: "AMTRELAY", 261: "RESINFO", 32768: "TA", 32769: "DLV",
+	}
+
+	qclassNames = map[int]string{
+		1: "IN", 2: "CS", 3: "CH", 4: "HS", 254: "NONE", 255: "ANY",
+	}
+
+	opcodeNames = map[int]string{
+		0: "QUERY", 1: "IQUERY", 2: "STATUS", 4: "NOTIFY", 5: "UPDATE",
+	}
+
+	rcodeNames = map[int]string{
+		0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN",
+		4: "NOTIMPL", 5: "REFUSED", 6: "YXDOMAIN", 7: "YXRRSET",
+		8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+	}
+)
+
+// codeName returns the mnemonic of code in names, or prefix followed by the
+// code in decimal.
+func codeName(names map[int]string, prefix string, code int) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("%s%d", prefix, code)
+}
@@ -0,0 +1,77 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Reasons for a failed scrape, as reported in logs.
+const (
+	reasonDial     = "dial"
+	reasonTLS      = "tls"
+	reasonTimeout  = "timeout"
+	reasonCanceled = "canceled"
+	reasonRead     = "read"
+	reasonParse    = "parse"
+	reasonShm      = "shm"
+	reasonUnbound  = "unbound_error"
+)
+
+// Reasons for a line of Unbound's reply to be rejected by the parser, as
+// counted by unbound_exporter_parse_errors_total.
+const (
+	lineMalformed    = "malformed_line"
+	lineInvalidValue = "invalid_value"
+)
+
+var lineErrorReasons = []string{lineMalformed, lineInvalidValue}
+
+// scrapeError is an error from one stage of a scrape.
+type scrapeError struct {
+	reason string
+	err    error
+}
+
+func (e *scrapeError) Error() string {
+	return e.reason + ": " + e.err.Error()
+}
+
+func (e *scrapeError) Unwrap() error {
+	return e.err
+}
+
+// lineError is a line of Unbound's reply that could not be parsed.
+type lineError struct {
+	reason string
+	line   string
+	err    error
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("%q: %s", e.line, e.err)
+}
+
+func (e *lineError) Unwrap() error {
+	return e.err
+}
+
+// failureReason classifies an error returned by a scrape made with ctx.
+// Running out of time is reported as a timeout whichever stage it happened
+// in, since the stage is then mostly a matter of luck.
+func failureReason(ctx context.Context, err error) string {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return reasonCanceled
+	}
+	var netErr net.Error
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return reasonTimeout
+	}
+	var scrapeErr *scrapeError
+	if errors.As(err, &scrapeErr) {
+		return scrapeErr.reason
+	}
+	return "unknown"
+}
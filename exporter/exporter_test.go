@@ -1,11 +1,22 @@
 package exporter
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
 )
 
 // TestCollect is a basic unit test for parsing the output format
@@ -26,7 +37,7 @@ func TestCollect(t *testing.T) {
 		done <- struct{}{}
 	}()
 
-	err = collectFromReader(compileMetrics(), testData, ch)
+	err = collectFromReader(compileMetrics(unboundMetrics, nil), testData, ch)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -34,8 +45,8 @@ func TestCollect(t *testing.T) {
 	close(ch)
 	<-done
 
-	if len(metrics) != 109 {
-		t.Fatal("expected 109 metrics, got ", len(metrics))
+	if len(metrics) != 125 {
+		t.Fatal("expected 125 metrics, got ", len(metrics))
 	}
 }
 
@@ -47,3 +58,565 @@ func TestLabels(t *testing.T) {
 		}
 	}
 }
+
+// gather collects all metrics of exp.
+func gather(t *testing.T, exp *UnboundExporter) map[string]*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exp)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+// collectorFunc collects the metrics sent by a function. It describes
+// none, so that registries accept metrics with descriptors created on the
+// fly.
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(chan<- *prometheus.Desc) {}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+// gatherFunc gathers the metrics sent by collect, keyed by name.
+func gatherFunc(t *testing.T, collect func(ch chan<- prometheus.Metric)) map[string]*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(collect))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+// gatherStats converts stats to metrics, keyed by name.
+func gatherStats(t *testing.T, stats []stat) map[string]*dto.MetricFamily {
+	t.Helper()
+	return gatherFunc(t, func(ch chan<- prometheus.Metric) {
+		collectStats(compileMetrics(unboundMetrics, nil), stats, nil, ch)
+	})
+}
+
+// TestCollectTimeout checks that a scrape of an Unbound that accepts the
+// connection but never answers is abandoned once its context expires.
+func TestCollectTimeout(t *testing.T) {
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+
+	exp, err := NewUnboundExporter(target, Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = exp.collectFromSocket(ctx, &scrapeTrace{})
+	if err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+	if reason := failureReason(ctx, err); reason != reasonTimeout {
+		t.Errorf("expected reason %q, got %q (%s)", reasonTimeout, reason, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scrape took %s to time out", elapsed)
+	}
+}
+
+// TestCoalescing checks that concurrent scrapes share one round trip.
+func TestCoalescing(t *testing.T) {
+	var connections atomic.Int32
+	serve := unboundtest.Commands(t, nil)
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		connections.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		serve(conn)
+	})
+
+	exp, err := NewUnboundExporter(target, Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if snap := exp.scrape(context.Background()); snap.err != nil {
+				t.Error(snap.err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := connections.Load(); n != 1 {
+		t.Errorf("expected 1 connection to Unbound, got %d", n)
+	}
+}
+
+// TestCoalescingCanceled checks that a scrape giving up on a shared round
+// trip does not make the others waiting for it fail.
+func TestCoalescingCanceled(t *testing.T) {
+	serve := unboundtest.Commands(t, nil)
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		time.Sleep(100 * time.Millisecond)
+		serve(conn)
+	})
+
+	exp, err := NewUnboundExporter(target, Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first scrape starts the round trip, with a short deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	first := make(chan snapshot)
+	go func() { first <- exp.scrape(ctx) }()
+	time.Sleep(5 * time.Millisecond)
+
+	if snap := exp.scrape(context.Background()); snap.err != nil {
+		t.Errorf("waiting scrape failed: %s", snap.err)
+	}
+	if snap := <-first; snap.err == nil {
+		t.Error("expected the first scrape to give up")
+	}
+}
+
+// TestCoalescingAbandoned checks that the connection of a round trip is
+// closed once every scrape waiting for it has given up.
+func TestCoalescingAbandoned(t *testing.T) {
+	closed := make(chan struct{})
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 64))
+		// Unbound never answers, and the read only ends when the exporter
+		// closes the connection.
+		_, _ = conn.Read(make([]byte, 64))
+		close(closed)
+	})
+
+	exp, err := NewUnboundExporter(target, Options{Timeout: time.Minute}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if snap := exp.scrape(ctx); snap.err == nil {
+		t.Error("expected the scrape to give up")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the abandoned connection was not closed")
+	}
+	// Give the round trip time to count a failure of its own, if it did.
+	time.Sleep(50 * time.Millisecond)
+	exp.mu.Lock()
+	defer exp.mu.Unlock()
+	if n := exp.scrapeErrors[reasonTimeout] + exp.scrapeErrors[reasonCanceled]; n != 1 {
+		t.Errorf("expected the timeout to be counted once, got %v", n)
+	}
+}
+
+// TestCoalescingWedged checks that without a timeout, a round trip to an
+// Unbound that never answers still ends, so that later scrapes do not keep
+// joining it.
+func TestCoalescingWedged(t *testing.T) {
+	defer func(bound time.Duration) { maxRoundTrip = bound }(maxRoundTrip)
+	maxRoundTrip = 50 * time.Millisecond
+
+	var connections atomic.Int32
+	wedged := make(chan struct{})
+	t.Cleanup(func() { close(wedged) })
+	serve := unboundtest.Commands(t, nil)
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		if connections.Add(1) == 1 {
+			<-wedged
+			return
+		}
+		serve(conn)
+	})
+
+	exp, err := NewUnboundExporter(target, Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap := exp.scrape(context.Background()); snap.err == nil {
+		t.Error("expected the wedged round trip to time out")
+	}
+	if snap := exp.scrape(context.Background()); snap.err != nil {
+		t.Errorf("scrape after the wedged round trip failed: %s", snap.err)
+	}
+}
+
+// TestPolling checks that in polling mode, scrapes are served from the last
+// poll without connecting to Unbound.
+func TestPolling(t *testing.T) {
+	var connections atomic.Int32
+	serve := unboundtest.Commands(t, nil)
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		connections.Add(1)
+		serve(conn)
+	})
+
+	exp, err := NewUnboundExporter(target, Options{PollInterval: time.Hour}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := gather(t, exp)
+	if up := metrics["unbound_up"].Metric[0].GetGauge().GetValue(); up != 0 {
+		t.Errorf("expected unbound_up 0 before the first poll, got %v", up)
+	}
+
+	exp.poll(context.Background())
+	for range 3 {
+		metrics = gather(t, exp)
+	}
+
+	if up := metrics["unbound_up"].Metric[0].GetGauge().GetValue(); up != 1 {
+		t.Errorf("expected unbound_up 1 after polling, got %v", up)
+	}
+	if _, ok := metrics["unbound_last_successful_scrape_timestamp_seconds"]; !ok {
+		t.Error("expected unbound_last_successful_scrape_timestamp_seconds")
+	}
+	if _, ok := metrics["unbound_queries_total"]; !ok {
+		t.Error("expected unbound_queries_total")
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("expected 1 connection to Unbound, got %d", n)
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	reply := "num.queries=10\nnot a stat\nnum.cachehits=ten\nnum.cachemiss=3\n"
+
+	_, rejected, err := readStats(strings.NewReader(reply), false)
+	if reason := failureReason(t.Context(), err); reason != reasonParse {
+		t.Errorf("strict: expected reason %q, got %q (%v)", reasonParse, reason, err)
+	}
+	if len(rejected) != 1 || rejected[0].reason != lineMalformed {
+		t.Errorf("strict: expected the malformed line to be rejected, got %v", rejected)
+	}
+
+	stats, rejected, err := readStats(strings.NewReader(reply), true)
+	if err != nil {
+		t.Fatalf("lenient: %s", err)
+	}
+	if len(stats) != 2 || stats[0] != (stat{"num.queries", 10}) || stats[1] != (stat{"num.cachemiss", 3}) {
+		t.Errorf("lenient: unexpected stats %v", stats)
+	}
+	if len(rejected) != 2 || rejected[0].reason != lineMalformed || rejected[1].reason != lineInvalidValue {
+		t.Errorf("lenient: unexpected rejected lines %v", rejected)
+	}
+
+	for _, lenient := range []bool{false, true} {
+		_, _, err = readStats(strings.NewReader("error unknown command 'stats_noreset'\n"), lenient)
+		if reason := failureReason(t.Context(), err); reason != reasonUnbound {
+			t.Errorf("lenient=%v: expected reason %q, got %q", lenient, reasonUnbound, reason)
+		}
+		if err == nil || !strings.Contains(err.Error(), "error unknown command 'stats_noreset'") {
+			t.Errorf("lenient=%v: expected Unbound's message in %v", lenient, err)
+		}
+	}
+}
+
+// TestLenientParsing checks that lines skipped in lenient mode are counted,
+// and that the rest of the reply is exported.
+func TestLenientParsing(t *testing.T) {
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 64))
+		_, _ = conn.Write([]byte("thread0.num.queries=10\nthread0.num.cachehits=\n"))
+	})
+	exp, err := NewUnboundExporter(target, Options{LenientParsing: true}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, exp)
+	if up := families["unbound_up"].GetMetric()[0].GetGauge().GetValue(); up != 1 {
+		t.Errorf("expected unbound_up 1, got %v", up)
+	}
+	if queries := families["unbound_queries_total"].GetMetric()[0].GetCounter().GetValue(); queries != 10 {
+		t.Errorf("expected 10 queries, got %v", queries)
+	}
+	for _, m := range families["unbound_exporter_parse_errors_total"].GetMetric() {
+		expected := 0.0
+		if m.GetLabel()[0].GetValue() == lineInvalidValue {
+			expected = 1
+		}
+		if m.GetCounter().GetValue() != expected {
+			t.Errorf("expected %v parse errors for %s, got %v", expected, m.GetLabel()[0].GetValue(), m.GetCounter().GetValue())
+		}
+	}
+}
+
+func TestUnmapped(t *testing.T) {
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+	exp, err := NewUnboundExporter(target, Options{Unmapped: UnmappedStat}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, exp)
+	keys := map[string]float64{}
+	for _, m := range families["unbound_stat"].GetMetric() {
+		keys[m.GetLabel()[0].GetValue()] = m.GetUntyped().GetValue()
+	}
+	for _, key := range []string{"mem.streamwait", "thread0.tcpusage", "total.tcpusage"} {
+		if _, ok := keys[key]; !ok {
+			t.Errorf("unmapped statistic %s not exported", key)
+		}
+	}
+	if _, ok := keys["thread0.num.queries"]; ok {
+		t.Error("mapped statistic thread0.num.queries exported as unmapped")
+	}
+	if _, ok := keys["total.num.queries"]; ok {
+		t.Error("sum of mapped per-thread statistics exported as unmapped")
+	}
+	if count := families["unbound_exporter_unmapped_keys"].GetMetric()[0].GetGauge().GetValue(); count != float64(len(keys)) {
+		t.Errorf("expected %d unmapped keys, got %v", len(keys), count)
+	}
+
+	// Sanitized names come with descriptors created on the fly, which a
+	// pedantic registry rejects, so they are checked without one.
+	metrics := compileMetrics(unboundMetrics, nil)
+	metrics.unmapped = UnmappedSanitize
+	var unmapped []string
+	sanitized := gatherFunc(t, func(ch chan<- prometheus.Metric) {
+		unmapped = collectStats(metrics, []stat{{"thread3.tcpusage", 2}, {"mem.streamwait", 1}}, nil, ch)
+	})
+	if len(unmapped) != 2 || sanitized["unbound_tcpusage"] == nil || sanitized["unbound_mem_streamwait"] == nil {
+		t.Errorf("unexpected sanitized metrics %v for %v", sanitized, unmapped)
+	}
+}
+
+// TestUnmappedConflicts checks that unmapped statistics whose sanitized
+// names are taken are skipped.
+func TestUnmappedConflicts(t *testing.T) {
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 64))
+		_, _ = conn.Write([]byte("thread0.tcpusage=1\ntcpusage=2\nup=3\nexporter.x=4\nmem.streamwait=5\n"))
+	})
+	exp, err := NewUnboundExporter(target, Options{Unmapped: UnmappedSanitize}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sanitized names come with descriptors created on the fly, which a
+	// pedantic registry rejects.
+	for range 2 {
+		values := map[string][]float64{}
+		for name, mf := range gatherFunc(t, exp.Collect) {
+			for _, m := range mf.GetMetric() {
+				values[name] = append(values[name], m.GetUntyped().GetValue()+m.GetGauge().GetValue())
+			}
+		}
+		if v := values["unbound_tcpusage"]; len(v) != 1 || v[0] != 1 {
+			t.Errorf("expected only threadN.tcpusage as unbound_tcpusage, got %v", v)
+		}
+		if v := values["unbound_up"]; len(v) != 1 || v[0] != 1 {
+			t.Errorf("expected unbound_up 1, got %v", v)
+		}
+		if _, ok := values["unbound_exporter_x"]; ok {
+			t.Error("unmapped statistic took over the exporter's prefix")
+		}
+		if v := values["unbound_mem_streamwait"]; len(v) != 1 || v[0] != 5 {
+			t.Errorf("expected unbound_mem_streamwait 5, got %v", v)
+		}
+	}
+}
+
+// TestReservedNames checks that the names of the metrics exported besides
+// the mapped ones are reserved from unmapped statistics.
+func TestReservedNames(t *testing.T) {
+	infra, err := os.ReadFile("testdata/dump_infra.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err := os.ReadFile("testdata/dump_requestlist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := unboundtest.Listen(t, unboundtest.Commands(t, map[string]string{
+		"status":            statusReply,
+		"dump_infra":        string(infra),
+		"dump_requestlist":  string(requests),
+		"list_auth_zones":   "example.org.\tserial 1\n",
+		"ratelimit_list":    "example.com. 2300 limit 1000\n",
+		"ip_ratelimit_list": "192.0.2.7 410 limit 100\n",
+	}))
+	opts := Options{
+		Unmapped:              UnmappedStat,
+		AccumulateCounters:    true,
+		Histogram:             HistogramBoth,
+		ResponseTimeQuantiles: []float64{0.5},
+		LabelLimits:           map[string]LabelLimit{"type": {Max: 1}},
+		Status:                true,
+		Infra:                 &InfraOptions{TopN: 1},
+		RequestList:           &RequestListOptions{TopN: 1},
+		RateLimit:             true,
+		AuthZones:             true,
+	}
+	exp, err := NewUnboundExporter(target, opts, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := LabelNames(nil)
+	for name, mf := range gather(t, exp) {
+		if !exp.metrics.names[name] && !reservedName(name) {
+			t.Errorf("%s is not reserved", name)
+		}
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if !labels[label.GetName()] {
+					t.Errorf("label %s of %s is not reserved", label.GetName(), name)
+				}
+			}
+		}
+	}
+
+	// A constant label repeating one of them would fail every scrape.
+	opts.ConstLabels = prometheus.Labels{"target": target, "thread": "a"}
+	_, err = NewUnboundExporter(target, opts, promslog.NewNopLogger())
+	if err == nil {
+		t.Error("expected an error for a constant thread label")
+	}
+}
+
+func TestZeroFill(t *testing.T) {
+	target := unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 64))
+		_, _ = conn.Write([]byte("num.answer.rcode.NOERROR=4\nnum.query.type.A=3\n"))
+	})
+
+	values := func(opts Options, name string) map[string]float64 {
+		t.Helper()
+		exp, err := NewUnboundExporter(target, opts, promslog.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]float64{}
+		for _, m := range gather(t, exp)[name].GetMetric() {
+			values[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+		return values
+	}
+
+	if rcodes := values(Options{}, "unbound_answer_rcodes_total"); len(rcodes) != 1 {
+		t.Errorf("expected only NOERROR without zero-fill, got %v", rcodes)
+	}
+	rcodes := values(Options{ZeroFill: true}, "unbound_answer_rcodes_total")
+	if rcodes["NOERROR"] != 4 || len(rcodes) != 7 {
+		t.Errorf("expected NOERROR 4 and zero-filled rcodes, got %v", rcodes)
+	}
+	if v, ok := rcodes["SERVFAIL"]; !ok || v != 0 {
+		t.Errorf("expected SERVFAIL 0, got %v", rcodes)
+	}
+
+	// Zero-filled values are only exported if the label limits keep them,
+	// and do not take the place of values Unbound counts.
+	limits := map[string]LabelLimit{"type": {Max: 1, Allow: []string{"AAAA"}}}
+	types := values(Options{ZeroFill: true, LabelLimits: limits}, "unbound_query_types_total")
+	if fmt.Sprint(types) != "map[A:3 AAAA:0]" {
+		t.Errorf("unexpected query types %v", types)
+	}
+}
+
+func TestScrapeMetrics(t *testing.T) {
+	reply := unboundtest.Testdata(t, "metrics.txt")
+	exp, err := NewUnboundExporter(unboundtest.Listen(t, unboundtest.Commands(t, nil)), Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, exp)
+	phases := map[string]bool{}
+	for _, m := range families["unbound_exporter_scrape_duration_seconds"].GetMetric() {
+		phases[m.GetLabel()[0].GetValue()] = true
+	}
+	if !phases[phaseDial] || !phases[phaseRead] || !phases[phaseParse] || phases[phaseTLS] {
+		t.Errorf("unexpected phases %v", phases)
+	}
+	gauge := func(name string) float64 {
+		return families[name].GetMetric()[0].GetGauge().GetValue()
+	}
+	if bytes := gauge("unbound_exporter_scrape_bytes_read"); bytes != float64(len(reply)) {
+		t.Errorf("expected %d bytes read, got %v", len(reply), bytes)
+	}
+	lines := float64(strings.Count(string(reply), "\n"))
+	if parsed := gauge("unbound_exporter_scrape_lines_parsed"); parsed != lines {
+		t.Errorf("expected %v lines parsed, got %v", lines, parsed)
+	}
+	if matched := gauge("unbound_exporter_scrape_lines_matched"); matched != lines-gauge("unbound_exporter_unmapped_keys") {
+		t.Errorf("expected the lines without a mapping not to be matched, got %v", matched)
+	}
+
+	exp, err = NewUnboundExporter(unboundtest.Listen(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 64))
+		_, _ = conn.Write([]byte("error command not found\n"))
+	}), Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gather(t, exp)
+	errors := map[string]float64{}
+	for _, m := range gather(t, exp)["unbound_exporter_scrape_errors_total"].GetMetric() {
+		errors[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+	}
+	if errors[reasonUnbound] != 2 || errors[reasonDial] != 0 || len(errors) != len(scrapeErrorReasons) {
+		t.Errorf("unexpected scrape errors %v", errors)
+	}
+	// The phase that failed is timed, and reported with the reason.
+	families = gather(t, exp)
+	phases = map[string]bool{}
+	for _, m := range families["unbound_exporter_scrape_duration_seconds"].GetMetric() {
+		phases[m.GetLabel()[0].GetValue()] = true
+	}
+	if !phases[phaseParse] {
+		t.Errorf("failed parse phase not timed, got %v", phases)
+	}
+	failure := families["unbound_exporter_last_scrape_failure"].GetMetric()
+	if len(failure) != 1 || failure[0].GetLabel()[0].GetValue() != phaseParse || failure[0].GetLabel()[1].GetValue() != reasonUnbound {
+		t.Errorf("unexpected failure %v", failure)
+	}
+
+	// A scrape giving up on a round trip counts as a failure of its own.
+	serve := unboundtest.Commands(t, nil)
+	exp, err = NewUnboundExporter(unboundtest.Listen(t, func(conn net.Conn) {
+		time.Sleep(200 * time.Millisecond)
+		serve(conn)
+	}), Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	snap := exp.scrape(ctx)
+	if snap.err == nil || snap.trace.failed != phaseWait || snap.trace.reason != reasonTimeout {
+		t.Errorf("unexpected failure %q %q: %v", snap.trace.failed, snap.trace.reason, snap.err)
+	}
+	exp.mu.Lock()
+	timeouts := exp.scrapeErrors[reasonTimeout]
+	exp.mu.Unlock()
+	if timeouts != 1 {
+		t.Errorf("expected 1 timeout, got %v", timeouts)
+	}
+}
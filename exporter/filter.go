@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"regexp"
+	"sort"
+)
+
+// latencyFamily is the family of unbound_response_time_seconds and the
+// metrics derived from it, besides the latency metrics of the mapping.
+const latencyFamily = "latency"
+
+// Families selects families of metrics by name, for instance to honour the
+// collect[] parameters of a scrape. A nil Families selects all of them.
+type Families map[string]bool
+
+func (f Families) selects(family string) bool {
+	return f == nil || f[family]
+}
+
+// NameFilter selects metrics by name, such as unbound_cache_hits_total.
+// Metrics are selected if they match Include, if set, and do not match
+// Exclude, if set. See NewNameFilter.
+type NameFilter struct {
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+// NewNameFilter compiles the include and exclude expressions, either of
+// which may be empty, anchored so that they must match whole names.
+func NewNameFilter(include, exclude string) (NameFilter, error) {
+	var f NameFilter
+	var err error
+	if include != "" {
+		f.Include, err = regexp.Compile("^(?:" + include + ")$")
+		if err != nil {
+			return f, err
+		}
+	}
+	if exclude != "" {
+		f.Exclude, err = regexp.Compile("^(?:" + exclude + ")$")
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func (f NameFilter) selects(name string) bool {
+	if f.Include != nil && !f.Include.MatchString(name) {
+		return false
+	}
+	return f.Exclude == nil || !f.Exclude.MatchString(name)
+}
+
+// Families returns the names of the families of metrics the exporter can
+// export, sorted.
+func (e *UnboundExporter) Families() []string {
+	seen := map[string]bool{latencyFamily: true}
+	families := []string{latencyFamily}
+	for _, metric := range e.metrics.metrics {
+		if !seen[metric.family] {
+			seen[metric.family] = true
+			families = append(families, metric.family)
+		}
+	}
+	sort.Strings(families)
+	return families
+}
@@ -0,0 +1,84 @@
+package exporter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestNameFilter(t *testing.T) {
+	filter, err := NewNameFilter("unbound_(cache|memory)_.*|unbound_response_time_seconds", "unbound_cache_misses_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+	exp, err := NewUnboundExporter(target, Options{NameFilter: filter}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, exp)
+	for _, name := range []string{"unbound_cache_hits_total", "unbound_memory_caches_bytes", "unbound_response_time_seconds", "unbound_up"} {
+		if families[name] == nil {
+			t.Errorf("%s not exported", name)
+		}
+	}
+	for _, name := range []string{"unbound_cache_misses_total", "unbound_queries_total", "unbound_query_types_total"} {
+		if families[name] != nil {
+			t.Errorf("%s exported despite the filter", name)
+		}
+	}
+
+	// The include expression must match whole names.
+	filter, err = NewNameFilter("unbound_cache", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.selects("unbound_cache_hits_total") {
+		t.Error("partial match of the include expression selects metric")
+	}
+
+	_, err = NewNameFilter("(", "")
+	if err == nil {
+		t.Error("invalid expression accepted")
+	}
+}
+
+func TestFamilies(t *testing.T) {
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+	exp, err := NewUnboundExporter(target, Options{}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for name := range gatherFunc(t, func(ch chan<- prometheus.Metric) {
+		exp.CollectFamilies(context.Background(), Families{"memory": true}, ch)
+	}) {
+		names[name] = true
+	}
+	for _, md := range unboundMetrics {
+		if md.family != "memory" && names["unbound_"+md.name] {
+			t.Errorf("unbound_%s of family %s exported", md.name, md.family)
+		}
+	}
+	if names["unbound_response_time_seconds"] {
+		t.Error("unbound_response_time_seconds exported")
+	}
+	if !names["unbound_memory_caches_bytes"] || !names["unbound_up"] {
+		t.Errorf("missing metrics in %v", names)
+	}
+
+	for _, family := range []string{"cache", "latency", "memory", "queries"} {
+		found := false
+		for _, f := range exp.Families() {
+			found = found || f == family
+		}
+		if !found {
+			t.Errorf("family %s missing from %v", family, exp.Families())
+		}
+	}
+}
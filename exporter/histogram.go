@@ -0,0 +1,201 @@
+package exporter
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Representations of unbound_response_time_seconds.
+const (
+	// HistogramClassic exports a classic histogram, with an le label per
+	// bucket.
+	HistogramClassic = "classic"
+	// HistogramNative exports a native histogram.
+	HistogramNative = "native"
+	// HistogramBoth exports a histogram with both representations, for
+	// the scraper to pick.
+	HistogramBoth = "both"
+)
+
+// Unbound's histogram buckets end at powers of two of microseconds below a
+// second, and at powers of two of seconds above. Native histograms of
+// schema 0 have buckets ending at powers of two of seconds, so below a
+// second, the native histogram's bucket bounds are 2^-20 / 10^-6, about
+// 0.954, times Unbound's. The first of Unbound's buckets, from 0 to 1µs,
+// becomes the zero bucket.
+const (
+	nativeSchema        = 0
+	nativeZeroThreshold = 0x1p-20
+)
+
+// nativeIndex returns the index of the native histogram bucket standing
+// for Unbound's bucket ending at end seconds.
+func nativeIndex(end float64) int {
+	if end >= 1 {
+		return int(math.Round(math.Log2(end)))
+	}
+	return int(math.Round(math.Log2(end*1e6))) - 20
+}
+
+// collectResponseTime exports the response time histogram, and the metrics
+// derived from it. buckets holds the count of each of Unbound's buckets,
+// keyed by its upper bound.
+func (m *metricSet) collectResponseTime(count uint64, sum float64, buckets map[float64]uint64, ch chan<- prometheus.Metric) {
+	sum, corrections := m.sum.monotonic(count, sum)
+	ch <- prometheus.MustNewConstMetric(
+		m.sumCorrections,
+		prometheus.CounterValue,
+		corrections)
+
+	if len(m.quantiles) > 0 {
+		ch <- prometheus.MustNewConstSummary(
+			m.responseTimeSummary,
+			count,
+			sum,
+			estimateQuantiles(m.quantiles, count, buckets))
+	}
+
+	var classic, native prometheus.Metric
+	if m.histogramMode != HistogramNative {
+		classic = classicHistogram(m.histogram, count, sum, buckets)
+	}
+	if m.histogramMode != HistogramClassic {
+		positive := make(map[int]int64, len(buckets))
+		var zero uint64
+		for end, n := range buckets {
+			if end <= 1e-6 {
+				zero += n
+			} else {
+				positive[nativeIndex(end)] += int64(n)
+			}
+		}
+		native = prometheus.MustNewConstNativeHistogram(
+			m.histogram, count, sum, positive, nil, zero,
+			nativeSchema, nativeZeroThreshold, time.Time{})
+	}
+	switch {
+	case classic == nil:
+		ch <- nativeHistogram{native, nil}
+	case native == nil:
+		ch <- classic
+	default:
+		ch <- nativeHistogram{native, classic}
+	}
+}
+
+// sumTracker keeps the sum of the response time histogram from going
+// backwards. Unbound does not print the sum, only the average rounded to the
+// microsecond, from which the sum is reconstructed as average times count.
+// Because of the rounding, the reconstruction can decrease while the count
+// increases, which rate() would take for a reset.
+type sumTracker struct {
+	mu          sync.Mutex
+	count       uint64
+	sum         float64
+	corrections float64
+}
+
+// monotonic returns the sum to export for a reconstructed sum, and the
+// number of times a reconstruction went backwards so far.
+func (t *sumTracker) monotonic(count uint64, sum float64) (float64, float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case count < t.count:
+		// Unbound restarted, or its counters were reset.
+	case sum < t.sum:
+		t.corrections++
+		sum = t.sum
+	case count == t.count:
+		// No new observations, so the sum cannot have changed.
+		sum = t.sum
+	}
+	t.count, t.sum = count, sum
+	return sum, t.corrections
+}
+
+// estimateQuantiles estimates the given quantiles of the observations
+// counted in buckets, keyed by upper bound, assuming that observations are
+// spread uniformly within each bucket, as histogram_quantile() does.
+func estimateQuantiles(quantiles []float64, count uint64, buckets map[float64]uint64) map[float64]float64 {
+	ends := make([]float64, 0, len(buckets))
+	for end := range buckets {
+		ends = append(ends, end)
+	}
+	sort.Float64s(ends)
+
+	estimates := make(map[float64]float64, len(quantiles))
+	for _, q := range quantiles {
+		estimates[q] = math.NaN()
+		if count == 0 {
+			continue
+		}
+		rank := q * float64(count)
+		var cumulative float64
+		for i, end := range ends {
+			n := float64(buckets[end])
+			if n == 0 || cumulative+n < rank {
+				cumulative += n
+				continue
+			}
+			start := 0.0
+			if i > 0 {
+				start = ends[i-1]
+			}
+			estimates[q] = start + (end-start)*(rank-cumulative)/n
+			break
+		}
+	}
+	return estimates
+}
+
+// classicHistogram converts Unbound's buckets to a cumulative histogram.
+func classicHistogram(desc *prometheus.Desc, count uint64, sum float64, buckets map[float64]uint64) prometheus.Metric {
+	keys := []float64{}
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	cumulative := make(map[float64]uint64, len(buckets))
+	prev := uint64(0)
+	for _, i := range keys {
+		cumulative[i] = buckets[i] + prev
+		prev = cumulative[i]
+	}
+	return prometheus.MustNewConstHistogram(desc, count, sum, cumulative)
+}
+
+// nativeHistogram is a native histogram, to which the buckets of a classic
+// histogram are added if not nil. Unlike the histograms of the prometheus
+// package, it has no created timestamp, which is unknown for Unbound's
+// histogram.
+type nativeHistogram struct {
+	native  prometheus.Metric
+	classic prometheus.Metric
+}
+
+func (h nativeHistogram) Desc() *prometheus.Desc {
+	return h.native.Desc()
+}
+
+func (h nativeHistogram) Write(out *dto.Metric) error {
+	err := h.native.Write(out)
+	if err != nil {
+		return err
+	}
+	out.Histogram.CreatedTimestamp = nil
+	if h.classic != nil {
+		var classic dto.Metric
+		err = h.classic.Write(&classic)
+		if err != nil {
+			return err
+		}
+		out.Histogram.Bucket = classic.Histogram.Bucket
+	}
+	return nil
+}
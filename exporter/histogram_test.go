@@ -0,0 +1,175 @@
+package exporter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestNativeIndex(t *testing.T) {
+	for end, index := range map[float64]int{
+		0.000002: -19,
+		0.000004: -18,
+		0.524288: -1,
+		1:        0,
+		2:        1,
+		524288:   19,
+	} {
+		if got := nativeIndex(end); got != index {
+			t.Errorf("nativeIndex(%v): expected %d, got %d", end, index, got)
+		}
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	// The raw counts of Unbound's buckets, by native bucket index.
+	raw := map[int]uint64{}
+	var zero, count uint64
+	for _, s := range testStats(t) {
+		matches := histogramPattern.FindStringSubmatch(s.key)
+		if matches == nil {
+			continue
+		}
+		end, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += uint64(s.value)
+		if strings.HasPrefix(s.key, "histogram.000000.000000.to.") {
+			zero += uint64(s.value)
+		} else if s.value != 0 {
+			raw[nativeIndex(end)] = uint64(s.value)
+		}
+	}
+
+	for _, mode := range []string{HistogramNative, HistogramBoth} {
+		target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+		exp, err := NewUnboundExporter(target, Options{Histogram: mode}, promslog.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := gather(t, exp)["unbound_response_time_seconds"].GetMetric()[0].GetHistogram()
+
+		if h.GetSchema() != 0 || h.GetZeroThreshold() != math.Ldexp(1, -20) {
+			t.Errorf("%s: unexpected schema %d or zero threshold %v", mode, h.GetSchema(), h.GetZeroThreshold())
+		}
+		if h.GetZeroCount() != zero || h.GetSampleCount() != count {
+			t.Errorf("%s: expected zero count %d and count %d, got %d and %d", mode, zero, count, h.GetZeroCount(), h.GetSampleCount())
+		}
+		if h.CreatedTimestamp != nil {
+			t.Errorf("%s: unexpected created timestamp", mode)
+		}
+
+		// Decode the spans and deltas of the positive buckets.
+		got := map[int]uint64{}
+		index, value, delta := 0, int64(0), 0
+		for _, span := range h.GetPositiveSpan() {
+			index += int(span.GetOffset())
+			for range span.GetLength() {
+				value += h.GetPositiveDelta()[delta]
+				delta++
+				if value != 0 {
+					got[index] = uint64(value)
+				}
+				index++
+			}
+		}
+		if len(got) != len(raw) {
+			t.Errorf("%s: expected buckets %v, got %v", mode, raw, got)
+		}
+		for i, n := range raw {
+			if got[i] != n {
+				t.Errorf("%s: bucket %d: expected %d, got %d", mode, i, n, got[i])
+			}
+		}
+
+		if classic := len(h.GetBucket()); (mode == HistogramBoth) != (classic == 40) {
+			t.Errorf("%s: unexpected %d classic buckets", mode, classic)
+		}
+	}
+}
+
+func TestSumTracker(t *testing.T) {
+	var tracker sumTracker
+	for _, step := range []struct {
+		count       uint64
+		sum         float64
+		expected    float64
+		corrections float64
+	}{
+		{10, 1.0, 1.0, 0},
+		{12, 0.99, 1.0, 1},
+		{12, 1.2, 1.0, 1},
+		{15, 1.5, 1.5, 1},
+		// A reset of the count resets the sum.
+		{3, 0.3, 0.3, 1},
+	} {
+		sum, corrections := tracker.monotonic(step.count, step.sum)
+		if sum != step.expected || corrections != step.corrections {
+			t.Errorf("count %d, sum %v: expected %v and %v corrections, got %v and %v",
+				step.count, step.sum, step.expected, step.corrections, sum, corrections)
+		}
+	}
+}
+
+func TestEstimateQuantiles(t *testing.T) {
+	buckets := map[float64]uint64{0.000001: 0, 0.000002: 10, 0.000004: 10}
+	estimates := estimateQuantiles([]float64{0, 0.5, 0.75, 1}, 20, buckets)
+	for q, expected := range map[float64]float64{0: 0.000001, 0.5: 0.000002, 0.75: 0.000003, 1: 0.000004} {
+		if math.Abs(estimates[q]-expected) > 1e-12 {
+			t.Errorf("quantile %v: expected %v, got %v", q, expected, estimates[q])
+		}
+	}
+
+	if estimate := estimateQuantiles([]float64{0.5}, 0, buckets)[0.5]; !math.IsNaN(estimate) {
+		t.Errorf("expected no estimate without observations, got %v", estimate)
+	}
+}
+
+func TestPerThreadLatency(t *testing.T) {
+	metrics := gatherStats(t, []stat{
+		{"thread1.recursion.time.avg", 0.25},
+		{"thread1.recursion.time.median", 0.125},
+		{"thread1.query.queue_time_us.max", 1500},
+	})
+	for name, expected := range map[string]float64{
+		"unbound_thread_recursion_time_seconds_avg":    0.25,
+		"unbound_thread_recursion_time_seconds_median": 0.125,
+		"unbound_query_queue_time_seconds_max":         0.0015,
+	} {
+		if len(metrics[name].GetMetric()) != 1 {
+			t.Errorf("expected one %s, got %d", name, len(metrics[name].GetMetric()))
+			continue
+		}
+		m := metrics[name].GetMetric()[0]
+		if m.GetGauge().GetValue() != expected || m.GetLabel()[0].GetValue() != "1" {
+			t.Errorf("%s: expected %v for thread 1, got %v", name, expected, m)
+		}
+	}
+}
+
+func TestResponseTimeQuantiles(t *testing.T) {
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+	exp, err := NewUnboundExporter(target, Options{ResponseTimeQuantiles: []float64{0.5, 0.99}}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := gather(t, exp)["unbound_response_time_estimated_seconds"].GetMetric()[0].GetSummary()
+	if summary.GetSampleCount() != 3 || len(summary.GetQuantile()) != 2 {
+		t.Fatalf("unexpected summary %v", summary)
+	}
+	// The three observations are in the buckets ending at 0.131072,
+	// 0.262144 and 0.524288 seconds.
+	if median := summary.GetQuantile()[0].GetValue(); median <= 0.131072 || median > 0.262144 {
+		t.Errorf("expected median in the second bucket, got %v", median)
+	}
+
+	_, err = NewUnboundExporter(target, Options{ResponseTimeQuantiles: []float64{1.5}}, promslog.NewNopLogger())
+	if err == nil {
+		t.Error("expected invalid quantile to be rejected")
+	}
+}
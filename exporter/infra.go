@@ -0,0 +1,224 @@
+package exporter
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InfraOptions enables the dump_infra command, which exports the health of
+// the upstream nameservers Unbound queries, and bounds the number of
+// nameservers exported.
+type InfraOptions struct {
+	// TopN is the number of nameservers with the highest round trip time
+	// exported, besides those of Zones.
+	TopN int
+	// Zones lists zones whose nameservers are always exported, such as
+	// "example.com.".
+	Zones []string
+}
+
+// infraCommand exports the entries of Unbound's infrastructure cache, one
+// per nameserver address and zone.
+type infraCommand struct {
+	topN  int
+	zones map[string]bool
+
+	hosts    *prometheus.Desc
+	rtt      *prometheus.Desc
+	srtt     *prometheus.Desc
+	rttVar   *prometheus.Desc
+	rto      *prometheus.Desc
+	timeouts *prometheus.Desc
+	ednsLame *prometheus.Desc
+	lame     *prometheus.Desc
+	ttl      *prometheus.Desc
+}
+
+func newInfraCommand(opts InfraOptions, constLabels prometheus.Labels) *infraCommand {
+	labels := []string{"ip", "zone"}
+	desc := func(name, help string, extra ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "infra", name),
+			help,
+			append(slices.Clone(labels), extra...), constLabels)
+	}
+	c := &infraCommand{
+		topN:  opts.TopN,
+		zones: make(map[string]bool, len(opts.Zones)),
+		hosts: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "infra", "hosts"),
+			"Number of entries of the infrastructure cache, exported or not.",
+			nil, constLabels),
+		rtt:      desc("rtt_seconds", "Round trip time to the nameserver, without timeouts, in seconds."),
+		srtt:     desc("smoothed_rtt_seconds", "Smoothed round trip time to the nameserver, in seconds."),
+		rttVar:   desc("rtt_variance_seconds", "Variance of the round trip time to the nameserver, in seconds."),
+		rto:      desc("rto_seconds", "Retransmission timeout for the nameserver, in seconds."),
+		timeouts: desc("timeouts", "Number of recent timeouts of queries to the nameserver, by query type.", "qtype"),
+		ednsLame: desc("edns_lame", "Whether the nameserver is known not to support EDNS."),
+		lame:     desc("lame", "Whether the nameserver is lame for the zone, by kind of lameness.", "kind"),
+		ttl:      desc("ttl_seconds", "Time until the entry expires from the infrastructure cache, in seconds."),
+	}
+	for _, zone := range opts.Zones {
+		c.zones[canonicalZone(zone)] = true
+	}
+	return c
+}
+
+// canonicalZone returns zone in lower case, with a trailing dot.
+func canonicalZone(zone string) string {
+	zone = strings.ToLower(zone)
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	return zone
+}
+
+func (c *infraCommand) command() string {
+	return "dump_infra"
+}
+
+func (c *infraCommand) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hosts
+	ch <- c.rtt
+	ch <- c.srtt
+	ch <- c.rttVar
+	ch <- c.rto
+	ch <- c.timeouts
+	ch <- c.ednsLame
+	ch <- c.lame
+	ch <- c.ttl
+}
+
+// infraHost is an entry of the infrastructure cache. Times are in
+// milliseconds, except ttl, in seconds.
+type infraHost struct {
+	ip, zone                              string
+	ttl, ping, rttVar, rtt, rto           int
+	timeoutA, timeoutAAAA, timeoutOther   int
+	ednsKnown, edns                       int
+	lameDNSSEC, lameRec, lameA, lameOther int
+}
+
+// parseInfraHost parses a line of dump_infra:
+//
+//	192.0.2.53 example.com. ttl 812 ping 12 var 4 rtt 50 rto 50 tA 0 tAAAA 0 tother 0 ednsknown 1 edns 0 delay 0 lame dnssec 0 rec 0 A 0 other 0
+//
+// Expired entries, which Unbound prints as "192.0.2.99 example. expired rto
+// 120000", are reported as not ok.
+func parseInfraHost(line string) (infraHost, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return infraHost{}, false, fmt.Errorf("%q: not an infra cache entry", line)
+	}
+	if fields[2] == "expired" {
+		return infraHost{}, false, nil
+	}
+
+	h := infraHost{ip: fields[0], zone: strings.ToLower(fields[1])}
+	values := map[string]*int{
+		"ttl": &h.ttl, "ping": &h.ping, "var": &h.rttVar, "rtt": &h.rtt, "rto": &h.rto,
+		"tA": &h.timeoutA, "tAAAA": &h.timeoutAAAA, "tother": &h.timeoutOther,
+		"ednsknown": &h.ednsKnown, "edns": &h.edns,
+		"dnssec": &h.lameDNSSEC, "rec": &h.lameRec, "A": &h.lameA, "other": &h.lameOther,
+	}
+	rest := fields[2:]
+	for len(rest) > 0 {
+		// "lame" introduces the lameness flags, and has no value of its
+		// own.
+		if rest[0] == "lame" {
+			rest = rest[1:]
+			continue
+		}
+		if len(rest) < 2 {
+			return infraHost{}, false, fmt.Errorf("%q: no value for %s", line, rest[0])
+		}
+		n, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return infraHost{}, false, fmt.Errorf("%q: %w", line, err)
+		}
+		if v, ok := values[rest[0]]; ok {
+			*v = n
+		}
+		rest = rest[2:]
+	}
+	return h, true, nil
+}
+
+func (c *infraCommand) parse(r io.Reader) (commandReply, error) {
+	reply := &infraReply{cmd: c}
+	var others []infraHost
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "error ") {
+			return nil, &scrapeError{reasonUnbound, errors.New(line)}
+		}
+		h, ok, err := parseInfraHost(line)
+		if err != nil {
+			return nil, &scrapeError{reasonParse, err}
+		}
+		if !ok {
+			continue
+		}
+		reply.total++
+		if c.zones[h.zone] {
+			reply.hosts = append(reply.hosts, h)
+		} else {
+			others = append(others, h)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &scrapeError{reasonRead, err}
+	}
+
+	// The slowest nameservers are the interesting ones.
+	slices.SortFunc(others, func(a, b infraHost) int {
+		return cmp.Or(cmp.Compare(b.rtt, a.rtt), strings.Compare(a.zone, b.zone), strings.Compare(a.ip, b.ip))
+	})
+	reply.hosts = append(reply.hosts, others[:min(c.topN, len(others))]...)
+	return reply, nil
+}
+
+// infraReply holds the entries of the infrastructure cache to export.
+type infraReply struct {
+	cmd   *infraCommand
+	total int
+	hosts []infraHost
+}
+
+func (r *infraReply) collect(ch chan<- prometheus.Metric) {
+	c := r.cmd
+	ch <- prometheus.MustNewConstMetric(c.hosts, prometheus.GaugeValue, float64(r.total))
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	flag := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	for _, h := range r.hosts {
+		gauge(c.rtt, float64(h.rtt)/1000, h.ip, h.zone)
+		gauge(c.srtt, float64(h.ping)/1000, h.ip, h.zone)
+		gauge(c.rttVar, float64(h.rttVar)/1000, h.ip, h.zone)
+		gauge(c.rto, float64(h.rto)/1000, h.ip, h.zone)
+		gauge(c.timeouts, float64(h.timeoutA), h.ip, h.zone, "A")
+		gauge(c.timeouts, float64(h.timeoutAAAA), h.ip, h.zone, "AAAA")
+		gauge(c.timeouts, float64(h.timeoutOther), h.ip, h.zone, "other")
+		gauge(c.ednsLame, flag(h.ednsKnown != 0 && h.edns == -1), h.ip, h.zone)
+		gauge(c.lame, flag(h.lameDNSSEC != 0), h.ip, h.zone, "dnssec")
+		gauge(c.lame, flag(h.lameRec != 0), h.ip, h.zone, "rec")
+		gauge(c.lame, flag(h.lameA != 0), h.ip, h.zone, "A")
+		gauge(c.lame, flag(h.lameOther != 0), h.ip, h.zone, "other")
+		gauge(c.ttl, float64(h.ttl), h.ip, h.zone)
+	}
+}
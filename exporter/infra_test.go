@@ -0,0 +1,84 @@
+package exporter
+
+import (
+	"os"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestParseInfraHost(t *testing.T) {
+	h, ok, err := parseInfraHost("198.51.100.7 Example.org. ttl 455 ping 210 var 60 rtt 450 rto 900 tA 2 tAAAA 0 tother 1 ednsknown 1 edns -1 delay 0 lame dnssec 0 rec 1 A 0 other 0")
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	expected := infraHost{
+		ip: "198.51.100.7", zone: "example.org.",
+		ttl: 455, ping: 210, rttVar: 60, rtt: 450, rto: 900,
+		timeoutA: 2, timeoutOther: 1, ednsKnown: 1, edns: -1, lameRec: 1,
+	}
+	if h != expected {
+		t.Errorf("expected %+v, got %+v", expected, h)
+	}
+
+	_, ok, err = parseInfraHost("192.0.2.99 expired.example. expired rto 120000")
+	if err != nil || ok {
+		t.Errorf("expected expired entry to be skipped, got %v %v", ok, err)
+	}
+	for _, line := range []string{"", "192.0.2.1 example. ttl", "192.0.2.1 example. ttl x"} {
+		_, _, err = parseInfraHost(line)
+		if err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestInfra(t *testing.T) {
+	dump, err := os.ReadFile("testdata/dump_infra.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := unboundtest.Listen(t, unboundtest.Commands(t, map[string]string{"dump_infra": string(dump)}))
+	opts := Options{Infra: &InfraOptions{TopN: 2, Zones: []string{"Example.com"}}}
+	exp, err := NewUnboundExporter(target, opts, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := gather(t, exp)
+
+	if hosts := families["unbound_infra_hosts"].GetMetric()[0].GetGauge().GetValue(); hosts != 6 {
+		t.Errorf("expected 6 unexpired hosts, got %v", hosts)
+	}
+	// Both nameservers of the allowed zone, and the two slowest others.
+	rtts := map[string]float64{}
+	for _, m := range families["unbound_infra_rtt_seconds"].GetMetric() {
+		rtts[m.GetLabel()[0].GetValue()+" "+m.GetLabel()[1].GetValue()] = m.GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"192.0.2.53 example.com.":   0.05,
+		"2001:db8::53 example.com.": 0.071,
+		"198.51.100.7 example.org.": 0.45,
+		"203.0.113.9 example.net.":  0.376,
+	}
+	if len(rtts) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, rtts)
+	}
+	for host, rtt := range expected {
+		if rtts[host] != rtt {
+			t.Errorf("%s: expected rtt %v, got %v", host, rtt, rtts[host])
+		}
+	}
+
+	for _, m := range families["unbound_infra_edns_lame"].GetMetric() {
+		lame := m.GetLabel()[0].GetValue() == "198.51.100.7"
+		if (m.GetGauge().GetValue() == 1) != lame {
+			t.Errorf("unexpected EDNS lameness %v", m)
+		}
+	}
+
+	_, err = NewUnboundExporter(target, Options{Infra: &InfraOptions{TopN: -1}}, promslog.NewNopLogger())
+	if err == nil {
+		t.Error("negative top N accepted")
+	}
+}
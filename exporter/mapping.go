@@ -0,0 +1,230 @@
+package exporter
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.yaml.in/yaml/v2"
+)
+
+//go:embed metrics.yml
+var builtinMapping []byte
+
+// unboundMetrics is the built-in mapping of Unbound's statistics to metrics.
+var unboundMetrics = mustParseBuiltinMapping()
+
+// mappingFile is the format of metrics.yml and of mapping files.
+type mappingFile struct {
+	Metrics []mappingEntry `yaml:"metrics"`
+}
+
+type mappingEntry struct {
+	Name    string   `yaml:"name"`
+	Family  string   `yaml:"family"`
+	Help    string   `yaml:"help"`
+	Type    string   `yaml:"type"`
+	Labels  []string `yaml:"labels"`
+	Pattern string   `yaml:"pattern"`
+	// Scale multiplies the values of the statistics, for instance to
+	// convert microseconds to seconds. Zero means 1.
+	Scale float64 `yaml:"scale"`
+	// ZeroFill lists values of the only label that are exported as zero
+	// when Unbound omits them, with -metrics.zero-fill.
+	ZeroFill []string `yaml:"zero_fill"`
+	// V2 renames the metric, or changes its type, in naming v2.
+	V2 *mappingRename `yaml:"v2"`
+	// Drop removes the built-in entry with the same name.
+	Drop bool `yaml:"drop"`
+}
+
+// mappingRename is the v2 name, type and help of an entry. Empty fields
+// keep those of the entry.
+type mappingRename struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	Type string `yaml:"type"`
+}
+
+var valueTypes = map[string]prometheus.ValueType{
+	"counter": prometheus.CounterValue,
+	"gauge":   prometheus.GaugeValue,
+	"untyped": prometheus.UntypedValue,
+}
+
+// otherFamily is the family of the entries that do not name one.
+const otherFamily = "other"
+
+func (e mappingEntry) description() (metricDescription, error) {
+	valueType, ok := valueTypes[e.Type]
+	if !ok {
+		return metricDescription{}, fmt.Errorf("metric %q: unknown type %q", e.Name, e.Type)
+	}
+	family := e.Family
+	if family == "" {
+		family = otherFamily
+	}
+	md := metricDescription{e.Name, e.Help, valueType, e.Labels, e.Pattern, e.Scale, family, e.ZeroFill, nil, nil}
+	if e.V2 != nil {
+		rename := metricRename{md.name, md.valueType, md.description}
+		if e.V2.Name != "" {
+			rename.name = e.V2.Name
+		}
+		if e.V2.Help != "" {
+			rename.description = e.V2.Help
+		}
+		if e.V2.Type != "" {
+			rename.valueType, ok = valueTypes[e.V2.Type]
+			if !ok {
+				return metricDescription{}, fmt.Errorf("metric %q: unknown v2 type %q", e.Name, e.V2.Type)
+			}
+		}
+		md.v2 = &rename
+	}
+	return md, nil
+}
+
+// Mapping is a table of metric mappings, consisting of the built-in table
+// with the changes of a mapping file applied.
+type Mapping struct {
+	metrics []metricDescription
+}
+
+// LoadMapping merges the mapping file at path, in JSON or YAML, into the
+// built-in table. Entries of the file with the name of a built-in entry
+// replace it, entries with drop set remove it, and other entries are
+// appended, so that they only match statistics no built-in entry matches.
+func LoadMapping(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file mappingFile
+	err = yaml.UnmarshalStrict(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	metrics := append([]metricDescription(nil), unboundMetrics...)
+	index := make(map[string]int, len(metrics))
+	for i, md := range metrics {
+		index[md.name] = i
+	}
+	seen := make(map[string]bool, len(file.Metrics))
+	var dropped []string
+	for _, entry := range file.Metrics {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("%s: metric without name", path)
+		}
+		if seen[entry.Name] {
+			return nil, fmt.Errorf("%s: duplicate metric %q", path, entry.Name)
+		}
+		seen[entry.Name] = true
+
+		i, builtin := index[entry.Name]
+		if entry.Drop {
+			if !builtin {
+				return nil, fmt.Errorf("%s: cannot drop unknown metric %q", path, entry.Name)
+			}
+			dropped = append(dropped, entry.Name)
+			continue
+		}
+		md, err := entry.description()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if builtin {
+			metrics[i] = md
+		} else {
+			metrics = append(metrics, md)
+		}
+	}
+
+	for _, name := range dropped {
+		for i, md := range metrics {
+			if md.name == name {
+				metrics = append(metrics[:i], metrics[i+1:]...)
+				break
+			}
+		}
+	}
+
+	err = validateMapping(metrics)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Mapping{metrics}, nil
+}
+
+// validateMapping checks that the entries of a table can be turned into
+// metrics: their names are unique and valid, and their patterns compile and
+// have a capture group for each label.
+func validateMapping(metrics []metricDescription) error {
+	names := make(map[string]bool, len(metrics))
+	for _, md := range metrics {
+		if names[md.name] {
+			return fmt.Errorf("duplicate metric %q", md.name)
+		}
+		names[md.name] = true
+		if md.v2 != nil && md.v2.name != md.name {
+			if names[md.v2.name] {
+				return fmt.Errorf("duplicate metric %q", md.v2.name)
+			}
+			names[md.v2.name] = true
+			if !model.LegacyValidation.IsValidMetricName(prometheus.BuildFQName("unbound", "", md.v2.name)) {
+				return fmt.Errorf("invalid metric name %q", md.v2.name)
+			}
+		}
+
+		if !model.LegacyValidation.IsValidMetricName(prometheus.BuildFQName("unbound", "", md.name)) {
+			return fmt.Errorf("invalid metric name %q", md.name)
+		}
+		for _, label := range md.labels {
+			if !model.LegacyValidation.IsValidLabelName(label) {
+				return fmt.Errorf("metric %q: invalid label name %q", md.name, label)
+			}
+		}
+		if md.pattern == "" {
+			return fmt.Errorf("metric %q: no pattern", md.name)
+		}
+		r, err := regexp.Compile(md.pattern)
+		if err != nil {
+			return fmt.Errorf("metric %q: %w", md.name, err)
+		}
+		if r.NumSubexp() != len(md.labels) {
+			return fmt.Errorf("metric %q: pattern has %d capture groups for %d labels", md.name, r.NumSubexp(), len(md.labels))
+		}
+		if len(md.zeroFill) > 0 && len(md.labels) != 1 {
+			return fmt.Errorf("metric %q: zero_fill requires exactly one label", md.name)
+		}
+	}
+	return nil
+}
+
+func mustParseBuiltinMapping() []metricDescription {
+	var file mappingFile
+	err := yaml.UnmarshalStrict(builtinMapping, &file)
+	if err != nil {
+		panic(fmt.Sprintf("parsing built-in metric mapping: %s", err))
+	}
+	metrics := make([]metricDescription, 0, len(file.Metrics))
+	for _, entry := range file.Metrics {
+		md, err := entry.description()
+		if err == nil && entry.Drop {
+			err = errors.New("drop in built-in metric mapping")
+		}
+		if err != nil {
+			panic(err)
+		}
+		metrics = append(metrics, md)
+	}
+	err = validateMapping(metrics)
+	if err != nil {
+		panic(fmt.Sprintf("built-in metric mapping: %s", err))
+	}
+	return metrics
+}
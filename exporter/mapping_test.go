@@ -0,0 +1,76 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoadMapping(t *testing.T) {
+	mapping, err := LoadMapping("testdata/mapping.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mapping.metrics) != len(unboundMetrics) {
+		t.Errorf("expected %d metrics, got %d", len(unboundMetrics), len(mapping.metrics))
+	}
+
+	testData, err := os.Open("testdata/metrics.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testData.Close()
+	stats, _, err := readStats(testData, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := gatherFunc(t, func(ch chan<- prometheus.Metric) {
+		collectStats(compileMetrics(mapping.metrics, nil), stats, nil, ch)
+	})
+	byName := map[string]int{}
+	for name, mf := range families {
+		byName[name] = len(mf.GetMetric())
+	}
+	if help := families["unbound_cache_hits_total"].GetHelp(); !strings.Contains(help, "answered from the cache") {
+		t.Errorf("built-in entry not replaced: %s", help)
+	}
+	if byName["unbound_answers_bogus"] != 0 {
+		t.Error("dropped metric unbound_answers_bogus still exported")
+	}
+	if byName["unbound_memory_stream_wait_bytes"] != 1 {
+		t.Error("added metric unbound_memory_stream_wait_bytes not exported")
+	}
+	if byName["unbound_cache_hits_total"] != 3 {
+		t.Errorf("expected 3 unbound_cache_hits_total, got %d", byName["unbound_cache_hits_total"])
+	}
+}
+
+func TestLoadMappingInvalid(t *testing.T) {
+	for name, mapping := range map[string]string{
+		"capture groups": "metrics:\n- {name: a, type: gauge, labels: [thread], pattern: '^a$'}\n",
+		"duplicate":      "metrics:\n- {name: a, type: gauge, pattern: '^a$'}\n- {name: a, type: gauge, pattern: '^b$'}\n",
+		"unknown type":   "metrics:\n- {name: a, type: summary, pattern: '^a$'}\n",
+		"drop unknown":   "metrics:\n- {name: a, drop: true}\n",
+		"bad pattern":    "metrics:\n- {name: a, type: gauge, pattern: '^(a$'}\n",
+		"no pattern":     "metrics:\n- {name: a, type: gauge}\n",
+		"bad name":       "metrics:\n- {name: a-b, type: gauge, pattern: '^a$'}\n",
+		"bad label":      "metrics:\n- {name: a, type: gauge, labels: [a-b], pattern: '^(a)$'}\n",
+		"unknown field":  "metrics:\n- {name: a, type: gauge, pattern: '^a$', regex: '^a$'}\n",
+		"zero fill":      "metrics:\n- {name: a, type: gauge, pattern: '^a$', zero_fill: [b]}\n",
+		"v2 duplicate":   "metrics:\n- {name: a, type: gauge, pattern: '^a$', v2: {name: queries_total}}\n",
+		"v2 type":        "metrics:\n- {name: a, type: gauge, pattern: '^a$', v2: {type: summary}}\n",
+	} {
+		path := filepath.Join(t.TempDir(), "mapping.yml")
+		err := os.WriteFile(path, []byte(mapping), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = LoadMapping(path)
+		if err == nil {
+			t.Errorf("%s: expected mapping to be rejected", name)
+		}
+	}
+}
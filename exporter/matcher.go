@@ -0,0 +1,246 @@
+package exporter
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// keyMatcher finds the first entry of a metric table whose pattern matches
+// a statistic's key, as trying each pattern in turn would, without running
+// the regular expressions.
+//
+// Patterns that are templates, made of literal text and capture groups of
+// one character class repeated, like ^thread(\d+)\.num\.queries$, are
+// compiled into a trie that is walked along the key. Other patterns are
+// left to the regexp package.
+type keyMatcher struct {
+	root *trieNode
+	// fallback holds the indices of the entries that are not templates,
+	// and all the indices of all entries.
+	fallback []int
+	all      []int
+	patterns []*regexp.Regexp
+}
+
+type trieNode struct {
+	// literals are the edges consuming literal text. No two start with the
+	// same byte.
+	literals  []*literal
+	wildcards []*wildcard
+	// entries are the indices of the templates ending here, in order.
+	entries []int
+	// min is the lowest index of a template ending in this subtree.
+	min int
+}
+
+// literal is an edge of the trie consuming literal text.
+type literal struct {
+	text string
+	next *trieNode
+}
+
+// wildcard is an edge of the trie consuming one or more characters of a
+// class.
+type wildcard struct {
+	// ranges holds the inclusive bounds of the class, in pairs, as in
+	// syntax.Regexp.Rune.
+	ranges  []rune
+	capture bool
+	next    *trieNode
+}
+
+// templateToken is a piece of a template: either literal text, or a
+// character class repeated at least once.
+type templateToken struct {
+	literal string
+	ranges  []rune
+	capture bool
+}
+
+func newKeyMatcher(patterns []*regexp.Regexp) *keyMatcher {
+	m := &keyMatcher{root: newTrieNode(), patterns: patterns}
+	for i, pattern := range patterns {
+		m.all = append(m.all, i)
+		tokens, ok := parseTemplate(pattern.String())
+		if !ok {
+			m.fallback = append(m.fallback, i)
+			continue
+		}
+		m.root.insert(tokens, i)
+	}
+	return m
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{min: -1}
+}
+
+// parseTemplate splits pattern into tokens, if it is a template anchored at
+// both ends.
+func parseTemplate(pattern string) ([]templateToken, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 ||
+		re.Sub[0].Op != syntax.OpBeginText || re.Sub[len(re.Sub)-1].Op != syntax.OpEndText {
+		return nil, false
+	}
+
+	var tokens []templateToken
+	for _, sub := range re.Sub[1 : len(re.Sub)-1] {
+		switch {
+		case sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0:
+			tokens = append(tokens, templateToken{literal: string(sub.Rune)})
+		case sub.Op == syntax.OpCapture && len(sub.Sub) == 1 && isClassPlus(sub.Sub[0]):
+			tokens = append(tokens, templateToken{ranges: sub.Sub[0].Sub[0].Rune, capture: true})
+		case isClassPlus(sub):
+			tokens = append(tokens, templateToken{ranges: sub.Sub[0].Rune})
+		default:
+			return nil, false
+		}
+	}
+	return tokens, true
+}
+
+func isClassPlus(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpPlus && re.Sub[0].Op == syntax.OpCharClass
+}
+
+func (n *trieNode) insert(tokens []templateToken, index int) {
+	if n.min == -1 || index < n.min {
+		n.min = index
+	}
+	if len(tokens) == 0 {
+		n.entries = append(n.entries, index)
+		return
+	}
+
+	token := tokens[0]
+	if token.ranges == nil {
+		if token.literal == "" {
+			n.insert(tokens[1:], index)
+			return
+		}
+		for _, l := range n.literals {
+			if l.text[0] != token.literal[0] {
+				continue
+			}
+			common := 1
+			for common < len(l.text) && common < len(token.literal) && l.text[common] == token.literal[common] {
+				common++
+			}
+			if common < len(l.text) {
+				// Split the edge where the texts diverge.
+				split := &trieNode{
+					literals: []*literal{{l.text[common:], l.next}},
+					min:      l.next.min,
+				}
+				l.text, l.next = l.text[:common], split
+			}
+			rest := append([]templateToken{{literal: token.literal[common:]}}, tokens[1:]...)
+			l.next.insert(rest, index)
+			return
+		}
+		l := &literal{text: token.literal, next: newTrieNode()}
+		n.literals = append(n.literals, l)
+		l.next.insert(tokens[1:], index)
+		return
+	}
+
+	for _, w := range n.wildcards {
+		if w.capture == token.capture && slices.Equal(w.ranges, token.ranges) {
+			w.next.insert(tokens[1:], index)
+			return
+		}
+	}
+	w := &wildcard{ranges: token.ranges, capture: token.capture, next: newTrieNode()}
+	n.wildcards = append(n.wildcards, w)
+	w.next.insert(tokens[1:], index)
+}
+
+// match returns the index of the first pattern matching key, and the values
+// of its capture groups.
+func (m *keyMatcher) match(key string) (int, []string, bool) {
+	best := matchResult{index: -1}
+	candidates := m.fallback
+	if utf8.ValidString(key) {
+		var buf [4]string
+		m.root.match(key, 0, buf[:0], &best)
+	} else {
+		// The trie compares bytes, while regular expressions see invalid
+		// UTF-8 as U+FFFD, so such keys are left to the latter.
+		candidates = m.all
+	}
+
+	for _, i := range candidates {
+		if best.index != -1 && i > best.index {
+			break
+		}
+		if matches := m.patterns[i].FindStringSubmatch(key); matches != nil {
+			return i, matches[1:], true
+		}
+	}
+	return best.index, best.captures, best.index != -1
+}
+
+type matchResult struct {
+	index    int
+	captures []string
+}
+
+// match walks the trie along key from pos, recording in best the template
+// with the lowest index that matches. Wildcards try their longest match
+// first, so that captures are the same as with greedy regular expressions.
+func (n *trieNode) match(key string, pos int, captures []string, best *matchResult) {
+	if best.index != -1 && n.min >= best.index {
+		return
+	}
+	if pos == len(key) {
+		if len(n.entries) > 0 {
+			best.index = n.entries[0]
+			best.captures = slices.Clone(captures)
+		}
+		return
+	}
+
+	for _, l := range n.literals {
+		if strings.HasPrefix(key[pos:], l.text) {
+			l.next.match(key, pos+len(l.text), captures, best)
+			break
+		}
+	}
+
+	for _, w := range n.wildcards {
+		end := pos
+		for end < len(key) {
+			r, size := utf8.DecodeRuneInString(key[end:])
+			if !inRanges(r, w.ranges) {
+				break
+			}
+			end += size
+		}
+		for end > pos {
+			next := captures
+			if w.capture {
+				next = append(captures, key[pos:end])
+			}
+			w.next.match(key, end, next, best)
+			_, size := utf8.DecodeLastRuneInString(key[pos:end])
+			end -= size
+		}
+	}
+}
+
+func inRanges(r rune, ranges []rune) bool {
+	for i := 0; i < len(ranges); i += 2 {
+		if ranges[i] <= r && r <= ranges[i+1] {
+			return true
+		}
+	}
+	return false
+}
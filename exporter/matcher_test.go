@@ -0,0 +1,194 @@
+package exporter
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// matchRegexp is the reference implementation of keyMatcher.match: trying
+// every pattern in turn.
+func matchRegexp(patterns []*regexp.Regexp, key string) (int, []string, bool) {
+	for i, pattern := range patterns {
+		if matches := pattern.FindStringSubmatch(key); matches != nil {
+			return i, matches[1:], true
+		}
+	}
+	return -1, nil, false
+}
+
+func builtinPatterns() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, md := range unboundMetrics {
+		patterns = append(patterns, regexp.MustCompile(md.pattern))
+	}
+	return patterns
+}
+
+// testStats reads testdata/metrics.txt.
+func testStats(tb testing.TB) []stat {
+	tb.Helper()
+	testData, err := os.Open("testdata/metrics.txt")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer testData.Close()
+	stats, _, err := readStats(testData, false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return stats
+}
+
+// syntheticStats returns the statistics of testdata/metrics.txt, with those
+// of thread 0 repeated for the given number of threads.
+func syntheticStats(tb testing.TB, threads int) []stat {
+	var stats []stat
+	for _, s := range testStats(tb) {
+		suffix, ok := strings.CutPrefix(s.key, "thread0.")
+		if ok {
+			for i := range threads {
+				stats = append(stats, stat{fmt.Sprintf("thread%d.%s", i, suffix), s.value})
+			}
+		} else if !strings.HasPrefix(s.key, "thread") {
+			stats = append(stats, s)
+		}
+	}
+	return stats
+}
+
+func checkMatcher(t *testing.T, patterns []*regexp.Regexp, keys []string) {
+	t.Helper()
+	m := newKeyMatcher(patterns)
+	for _, key := range keys {
+		i, captures, ok := m.match(key)
+		wantI, wantCaptures, wantOK := matchRegexp(patterns, key)
+		if i != wantI || ok != wantOK || !slices.Equal(captures, wantCaptures) {
+			t.Errorf("%q: got %d %q %v, expected %d %q %v", key, i, captures, ok, wantI, wantCaptures, wantOK)
+		}
+	}
+}
+
+func TestKeyMatcher(t *testing.T) {
+	var keys []string
+	for _, s := range syntheticStats(t, 64) {
+		keys = append(keys, s.key)
+	}
+	keys = append(keys,
+		"",
+		"thread",
+		"thread.num.queries",
+		"threadx.num.queries",
+		"thread12.num.queries.x",
+		"thread12.num.queriesx",
+		"num.query.type.",
+		"num.query.type.TYPE65280",
+		"num.query.tls.resume",
+		"num.rpz.action.rpz-client-ip",
+		"mem.cache.rrset.x",
+		"time.up\n",
+		"num.query.type.\xff",
+		"thread٣.num.queries",
+	)
+	checkMatcher(t, builtinPatterns(), keys)
+
+	// Patterns that overlap, need backtracking, are ambiguous or are not
+	// templates.
+	patterns := []*regexp.Regexp{
+		regexp.MustCompile(`^a(\w+)(\w+)$`),
+		regexp.MustCompile(`^a\.(\w+)\.(\d+)$`),
+		regexp.MustCompile(`^a\.(\d+)\.(\w+)$`),
+		regexp.MustCompile(`^b(?i)c$`),
+		regexp.MustCompile(`^b\.(x|y)$`),
+		regexp.MustCompile(`c\.d`),
+		regexp.MustCompile(`^[a-z]+\.[0-9]+$`),
+		regexp.MustCompile(`^(\w+)\.(\w+)\.(\w+)$`),
+		regexp.MustCompile(`^é(\pL+)$`),
+	}
+	checkMatcher(t, patterns, []string{
+		"abc", "abcdef", "a.b.1", "a.1.b", "a.1.1", "bc", "bC", "b.x", "b.z",
+		"xc.dx", "c.d", "ab.12", "ab.12x", "x.y.z", "a.b.c.d", "éa", "éàb", "é",
+	})
+}
+
+func TestIsCounter(t *testing.T) {
+	metrics := compileMetrics(unboundMetrics, nil)
+	// isCounterRegexp is the reference implementation of isCounter.
+	isCounterRegexp := func(key string) bool {
+		if histogramPattern.MatchString(key) {
+			return true
+		}
+		for _, metric := range metrics.metrics {
+			if metric.pattern.MatchString(key) {
+				return metric.counter
+			}
+		}
+		return false
+	}
+	for _, s := range append(testStats(t), stat{key: "num.query.type.TYPE65280"}, stat{key: "histogram.x"}) {
+		if got, want := metrics.isCounter(s.key), isCounterRegexp(s.key); got != want {
+			t.Errorf("%q: got %v, expected %v", s.key, got, want)
+		}
+	}
+}
+
+func FuzzKeyMatcher(f *testing.F) {
+	for _, s := range testStats(f) {
+		f.Add(s.key)
+	}
+	patterns := builtinPatterns()
+	m := newKeyMatcher(patterns)
+	f.Fuzz(func(t *testing.T, key string) {
+		i, captures, ok := m.match(key)
+		wantI, wantCaptures, wantOK := matchRegexp(patterns, key)
+		if i != wantI || ok != wantOK || !slices.Equal(captures, wantCaptures) {
+			t.Errorf("%q: got %d %q %v, expected %d %q %v", key, i, captures, ok, wantI, wantCaptures, wantOK)
+		}
+	})
+}
+
+func BenchmarkMatch(b *testing.B) {
+	patterns := builtinPatterns()
+	m := newKeyMatcher(patterns)
+	for _, threads := range []int{3, 64} {
+		stats := syntheticStats(b, threads)
+		b.Run(fmt.Sprintf("threads=%d/regexp", threads), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				for _, s := range stats {
+					matchRegexp(patterns, s.key)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("threads=%d/trie", threads), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				for _, s := range stats {
+					m.match(s.key)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCollectStats(b *testing.B) {
+	metrics := compileMetrics(unboundMetrics, nil)
+	for _, threads := range []int{3, 64} {
+		stats := syntheticStats(b, threads)
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			b.ReportAllocs()
+			ch := make(chan prometheus.Metric, len(stats)+1)
+			for b.Loop() {
+				collectStats(metrics, stats, nil, ch)
+				for len(ch) > 0 {
+					<-ch
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package exporter
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Naming schemes select the names and types of the metrics.
+const (
+	// NamingV1 keeps the names and types of the exporter's first releases,
+	// some of which do not follow the Prometheus conventions.
+	NamingV1 = "v1"
+	// NamingV2 applies the v2 names and types of the mapping.
+	NamingV2 = "v2"
+	// NamingBoth exports the metrics that were renamed under both names,
+	// for a migration period.
+	NamingBoth = "both"
+)
+
+// metricRename is the name, type and help of a metric in naming v2.
+type metricRename struct {
+	name        string
+	valueType   prometheus.ValueType
+	description string
+}
+
+// namingTable adapts table to the naming scheme. In NamingBoth, the v2
+// renames become aliases, which compileMetrics turns into second outputs.
+// Metrics whose type changes but not their name cannot be exported twice,
+// and get their v2 type.
+func namingTable(table []metricDescription, naming string) []metricDescription {
+	adapted := make([]metricDescription, 0, len(table))
+	for _, md := range table {
+		switch {
+		case md.v2 == nil:
+		case naming == NamingBoth && md.v2.name != md.name:
+			md.alias = md.v2
+		case naming == NamingV2 || naming == NamingBoth:
+			md.name = md.v2.name
+			md.valueType = md.v2.valueType
+			md.description = md.v2.description
+		}
+		adapted = append(adapted, md)
+	}
+	return adapted
+}
@@ -0,0 +1,54 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestNaming(t *testing.T) {
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+	for _, tc := range []struct {
+		naming  string
+		present []string
+		absent  []string
+		elapsed dto.MetricType
+	}{
+		{NamingV1, []string{"unbound_answers_bogus", "unbound_msg_cache_count"}, []string{"unbound_answers_bogus_total", "unbound_msg_cache_entries"}, dto.MetricType_COUNTER},
+		{NamingV2, []string{"unbound_answers_bogus_total", "unbound_msg_cache_entries"}, []string{"unbound_answers_bogus", "unbound_msg_cache_count"}, dto.MetricType_GAUGE},
+		{NamingBoth, []string{"unbound_answers_bogus", "unbound_answers_bogus_total", "unbound_msg_cache_count", "unbound_msg_cache_entries"}, nil, dto.MetricType_GAUGE},
+	} {
+		exp, err := NewUnboundExporter(target, Options{Naming: tc.naming}, promslog.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		families := gather(t, exp)
+		for _, name := range tc.present {
+			if families[name] == nil {
+				t.Errorf("%s: %s missing", tc.naming, name)
+			}
+		}
+		for _, name := range tc.absent {
+			if families[name] != nil {
+				t.Errorf("%s: %s exported", tc.naming, name)
+			}
+		}
+		if typ := families["unbound_time_elapsed_seconds"].GetType(); typ != tc.elapsed {
+			t.Errorf("%s: expected unbound_time_elapsed_seconds to be a %v, got %v", tc.naming, tc.elapsed, typ)
+		}
+	}
+
+	// Both naming schemes and both thread modes at once.
+	exp, err := NewUnboundExporter(target, Options{Naming: NamingBoth, ThreadMode: ThreadModeBoth}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gather(t, exp)
+
+	_, err = NewUnboundExporter(target, Options{Naming: "v3"}, promslog.NewNopLogger())
+	if err == nil {
+		t.Error("unknown naming scheme accepted")
+	}
+}
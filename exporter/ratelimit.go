@@ -0,0 +1,158 @@
+package exporter
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultRateLimitTopN is the number of offenders exported when the
+// configuration file has no label limit for their label.
+const defaultRateLimitTopN = 10
+
+// rateLimitCommand exports the domains or client addresses over their rate
+// limit, from ratelimit_list or ip_ratelimit_list. Unbound lists only the
+// entries over their limit.
+type rateLimitCommand struct {
+	name   string
+	domain bool
+	limit  LabelLimit
+	allow  map[string]bool
+
+	overLimit *prometheus.Desc
+	rate      *prometheus.Desc
+	rateLimit *prometheus.Desc
+}
+
+// newRateLimitCommand returns the command for ratelimit_list, with domain
+// true, or ip_ratelimit_list. The limit of the domain or ip label in limits
+// bounds the offenders exported: the Max with the highest rate on each
+// scrape, besides those in Allow. Unlike for other labels, no value is kept
+// for good, and the rest are left out rather than folded into other.
+func newRateLimitCommand(domain bool, limits map[string]LabelLimit, constLabels prometheus.Labels) *rateLimitCommand {
+	name, subsystem, label, what := "ip_ratelimit_list", "ip_ratelimit", "ip", "client addresses"
+	if domain {
+		name, subsystem, label, what = "ratelimit_list", "ratelimit", "domain", "domains"
+	}
+	c := &rateLimitCommand{
+		name:   name,
+		domain: domain,
+		limit:  LabelLimit{Max: defaultRateLimitTopN},
+		overLimit: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", subsystem, "over_limit"),
+			fmt.Sprintf("Number of %s over their rate limit.", what),
+			nil, constLabels),
+		rate: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", subsystem, "queries_per_second"),
+			fmt.Sprintf("Query rate of the %s over their rate limit with the highest rate.", what),
+			[]string{label}, constLabels),
+		rateLimit: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", subsystem, "limit_queries_per_second"),
+			fmt.Sprintf("Rate limit of the %s over it with the highest rate.", what),
+			[]string{label}, constLabels),
+	}
+	if limit, ok := limits[label]; ok && limit.applies(prometheus.BuildFQName("unbound", subsystem, "queries_per_second")) {
+		c.limit = limit
+	}
+	c.allow = make(map[string]bool, len(c.limit.Allow))
+	for _, value := range c.limit.Allow {
+		if domain {
+			value = canonicalZone(value)
+		}
+		c.allow[value] = true
+	}
+	return c
+}
+
+func (c *rateLimitCommand) command() string {
+	return c.name
+}
+
+func (c *rateLimitCommand) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.overLimit
+	ch <- c.rate
+	ch <- c.rateLimit
+}
+
+// rateLimited is an entry of ratelimit_list or ip_ratelimit_list.
+type rateLimited struct {
+	name        string
+	rate, limit int
+}
+
+// parseRateLimited parses a line of ratelimit_list or ip_ratelimit_list:
+//
+//	example.com. 2300 limit 1000
+//	192.0.2.7 410 limit 100
+func parseRateLimited(line string) (rateLimited, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[2] != "limit" {
+		return rateLimited{}, fmt.Errorf("%q: not a rate limit entry", line)
+	}
+	rate, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return rateLimited{}, fmt.Errorf("%q: %w", line, err)
+	}
+	limit, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return rateLimited{}, fmt.Errorf("%q: %w", line, err)
+	}
+	return rateLimited{fields[0], rate, limit}, nil
+}
+
+func (c *rateLimitCommand) parse(r io.Reader) (commandReply, error) {
+	reply := &rateLimitReply{cmd: c}
+	var others []rateLimited
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "error ") {
+			return nil, &scrapeError{reasonUnbound, errors.New(line)}
+		}
+		e, err := parseRateLimited(line)
+		if err != nil {
+			return nil, &scrapeError{reasonParse, err}
+		}
+		if c.domain {
+			e.name = strings.ToLower(e.name)
+		}
+		reply.total++
+		if c.allow[e.name] {
+			reply.entries = append(reply.entries, e)
+		} else {
+			others = append(others, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &scrapeError{reasonRead, err}
+	}
+
+	slices.SortFunc(others, func(a, b rateLimited) int {
+		return cmp.Or(cmp.Compare(b.rate, a.rate), strings.Compare(a.name, b.name))
+	})
+	reply.entries = append(reply.entries, others[:min(c.limit.Max, len(others))]...)
+	return reply, nil
+}
+
+// rateLimitReply holds the entries over their rate limit to export.
+type rateLimitReply struct {
+	cmd     *rateLimitCommand
+	total   int
+	entries []rateLimited
+}
+
+func (r *rateLimitReply) collect(ch chan<- prometheus.Metric) {
+	c := r.cmd
+	ch <- prometheus.MustNewConstMetric(c.overLimit, prometheus.GaugeValue, float64(r.total))
+	for _, e := range r.entries {
+		ch <- prometheus.MustNewConstMetric(c.rate, prometheus.GaugeValue, float64(e.rate), e.name)
+		ch <- prometheus.MustNewConstMetric(c.rateLimit, prometheus.GaugeValue, float64(e.limit), e.name)
+	}
+}
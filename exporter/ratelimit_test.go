@@ -0,0 +1,94 @@
+package exporter
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestParseRateLimited(t *testing.T) {
+	e, err := parseRateLimited("example.com. 2300 limit 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (rateLimited{"example.com.", 2300, 1000}); e != expected {
+		t.Errorf("expected %+v, got %+v", expected, e)
+	}
+	for _, line := range []string{"", "192.0.2.7 410", "192.0.2.7 410 max 100", "192.0.2.7 x limit 100"} {
+		if _, err := parseRateLimited(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	target := unboundtest.Listen(t, unboundtest.Commands(t, map[string]string{
+		"ratelimit_list":    "Example.com. 2300 limit 1000\nexample.net. 1500 limit 1000\nexample.org. 1200 limit 1000\nslow.example. 1001 limit 1000\n",
+		"ip_ratelimit_list": "192.0.2.7 410 limit 100\n",
+	}))
+	opts := Options{
+		RateLimit:   true,
+		LabelLimits: map[string]LabelLimit{"domain": {Max: 1, Allow: []string{"Slow.Example"}}},
+	}
+	exp, err := NewUnboundExporter(target, opts, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := gather(t, exp)
+
+	if over := families["unbound_ratelimit_over_limit"].GetMetric()[0].GetGauge().GetValue(); over != 4 {
+		t.Errorf("expected 4 domains over limit, got %v", over)
+	}
+	// The allowed domain, and the one with the highest rate.
+	rates := map[string]float64{}
+	for _, m := range families["unbound_ratelimit_queries_per_second"].GetMetric() {
+		rates[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	if len(rates) != 2 || rates["example.com."] != 2300 || rates["slow.example."] != 1001 {
+		t.Errorf("unexpected domain rates %v", rates)
+	}
+
+	// Client addresses fall back to the default limit.
+	if over := families["unbound_ip_ratelimit_over_limit"].GetMetric()[0].GetGauge().GetValue(); over != 1 {
+		t.Errorf("expected 1 address over limit, got %v", over)
+	}
+	limits := families["unbound_ip_ratelimit_limit_queries_per_second"].GetMetric()
+	if len(limits) != 1 || limits[0].GetLabel()[0].GetValue() != "192.0.2.7" || limits[0].GetGauge().GetValue() != 100 {
+		t.Errorf("unexpected address limits %v", limits)
+	}
+}
+
+// TestRateLimitOffenders checks that the offenders are chosen anew on each
+// scrape, unlike the values kept by label limits, so that the first ones
+// seen do not take the slots for good.
+func TestRateLimitOffenders(t *testing.T) {
+	var reply atomic.Value
+	reply.Store("192.0.2.7 410 limit 100\n192.0.2.8 120 limit 100\n")
+	target := unboundtest.Listen(t, unboundtest.Serve(t, func(command string) (string, bool) {
+		return reply.Load().(string), command == "ip_ratelimit_list"
+	}))
+	opts := Options{RateLimit: true, LabelLimits: map[string]LabelLimit{"ip": {Max: 1}}}
+	exp, err := NewUnboundExporter(target, opts, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offenders := func() map[string]float64 {
+		t.Helper()
+		rates := map[string]float64{}
+		for _, m := range gather(t, exp)["unbound_ip_ratelimit_queries_per_second"].GetMetric() {
+			rates[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		return rates
+	}
+	if rates := offenders(); fmt.Sprint(rates) != "map[192.0.2.7:410]" {
+		t.Errorf("unexpected offenders %v", rates)
+	}
+	reply.Store("192.0.2.8 130 limit 100\n198.51.100.1 900 limit 100\n")
+	if rates := offenders(); fmt.Sprint(rates) != "map[198.51.100.1:900]" {
+		t.Errorf("unexpected offenders on the second scrape %v", rates)
+	}
+}
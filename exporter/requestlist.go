@@ -0,0 +1,210 @@
+package exporter
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RequestListOptions enables the dump_requestlist command, which exports
+// the queries Unbound is working on, and bounds the number of query names
+// exported.
+type RequestListOptions struct {
+	// TopN is the number of query names exported with the age of their
+	// oldest outstanding query.
+	TopN int
+}
+
+// requestListAgeBuckets are the buckets of unbound_request_list_age_seconds,
+// up to the time clients commonly give up.
+var requestListAgeBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 30, 60}
+
+// requestListCommand exports a summary of the mesh states of dump_requestlist.
+type requestListCommand struct {
+	topN int
+
+	age         *prometheus.Desc
+	queries     *prometheus.Desc
+	moduleState *prometheus.Desc
+	stuck       *prometheus.Desc
+}
+
+func newRequestListCommand(opts RequestListOptions, constLabels prometheus.Labels) *requestListCommand {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "request_list", name),
+			help, labels, constLabels)
+	}
+	return &requestListCommand{
+		topN:        opts.TopN,
+		age:         desc("age_seconds", "Time clients have been waiting for the outstanding queries of the request list, in seconds.", "thread"),
+		queries:     desc("queries", "Number of outstanding queries of the request list, by query type.", "thread", "qtype"),
+		moduleState: desc("module_state", "Number of outstanding queries of the request list, by current module and its state.", "thread", "module", "state"),
+		stuck:       desc("stuck_age_seconds", "Time clients have been waiting for the oldest outstanding query for the name and type, for the longest waiting ones, in seconds.", "qname", "qtype"),
+	}
+}
+
+func (c *requestListCommand) command() string {
+	return "dump_requestlist"
+}
+
+func (c *requestListCommand) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.age
+	ch <- c.queries
+	ch <- c.moduleState
+	ch <- c.stuck
+}
+
+// request is an entry of the request list.
+type request struct {
+	thread        string
+	qtype, qname  string
+	module, state string
+	// waiting tells whether a client is waiting for the answer, for age
+	// seconds. Queries Unbound makes for itself have no client.
+	waiting bool
+	age     float64
+}
+
+// parseRequest parses an entry of dump_requestlist:
+//
+//	0    A IN example.com. 1.204000 iterator wait for 192.0.2.53
+//	1   DS IN example. - validator wants DNSKEY IN example.
+//	2 AAAA IN example.org. 0.012000 validator is module_wait_module
+//
+// The module status is "<module> wait for ..." while the iterator waits for
+// an upstream reply, "<module> wants ..." while it waits for a sub-query,
+// and "<module> is <state>" otherwise.
+func parseRequest(line string) (request, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return request{}, fmt.Errorf("%q: not a request list entry", line)
+	}
+	r := request{qtype: fields[1], qname: strings.ToLower(fields[3]), module: fields[5]}
+	if fields[4] != "-" {
+		age, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return request{}, fmt.Errorf("%q: %w", line, err)
+		}
+		r.waiting, r.age = true, age
+	}
+	switch fields[6] {
+	case "wait":
+		r.state = "wait_reply"
+	case "wants":
+		r.state = "wait_subquery"
+	case "is":
+		if len(fields) < 8 {
+			return request{}, fmt.Errorf("%q: no module state", line)
+		}
+		r.state = strings.TrimPrefix(fields[7], "module_")
+	default:
+		return request{}, fmt.Errorf("%q: unknown module status", line)
+	}
+	return r, nil
+}
+
+func (c *requestListCommand) parse(r io.Reader) (commandReply, error) {
+	reply := &requestListReply{cmd: c}
+	thread := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "error "):
+			return nil, &scrapeError{reasonUnbound, errors.New(line)}
+		case strings.HasPrefix(line, "thread #"):
+			thread = strings.TrimPrefix(line, "thread #")
+			reply.threads = append(reply.threads, thread)
+			continue
+		case strings.HasPrefix(line, "#"):
+			// The header of the columns.
+			continue
+		}
+		req, err := parseRequest(line)
+		if err != nil {
+			return nil, &scrapeError{reasonParse, err}
+		}
+		req.thread = thread
+		reply.requests = append(reply.requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &scrapeError{reasonRead, err}
+	}
+	return reply, nil
+}
+
+// requestListReply holds the entries of the request list of each thread
+// Unbound dumped.
+type requestListReply struct {
+	cmd      *requestListCommand
+	threads  []string
+	requests []request
+}
+
+func (r *requestListReply) collect(ch chan<- prometheus.Metric) {
+	c := r.cmd
+	for _, thread := range r.threads {
+		var ages []float64
+		queries := map[string]int{}
+		states := map[[2]string]int{}
+		for _, req := range r.requests {
+			if req.thread != thread {
+				continue
+			}
+			if req.waiting {
+				ages = append(ages, req.age)
+			}
+			queries[req.qtype]++
+			states[[2]string{req.module, req.state}]++
+		}
+
+		buckets := make(map[float64]uint64, len(requestListAgeBuckets))
+		for _, bound := range requestListAgeBuckets {
+			buckets[bound] = 0
+		}
+		sum := 0.0
+		for _, age := range ages {
+			sum += age
+			for _, bound := range requestListAgeBuckets {
+				if age <= bound {
+					buckets[bound]++
+				}
+			}
+		}
+		ch <- prometheus.MustNewConstHistogram(c.age, uint64(len(ages)), sum, buckets, thread)
+		for qtype, n := range queries {
+			ch <- prometheus.MustNewConstMetric(c.queries, prometheus.GaugeValue, float64(n), thread, qtype)
+		}
+		for state, n := range states {
+			ch <- prometheus.MustNewConstMetric(c.moduleState, prometheus.GaugeValue, float64(n), thread, state[0], state[1])
+		}
+	}
+
+	// The same query can be outstanding on several threads, or in several
+	// classes, so keep the oldest.
+	oldest := map[[2]string]float64{}
+	for _, req := range r.requests {
+		key := [2]string{req.qname, req.qtype}
+		if age, ok := oldest[key]; req.waiting && (!ok || req.age > age) {
+			oldest[key] = req.age
+		}
+	}
+	keys := make([][2]string, 0, len(oldest))
+	for key := range oldest {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		return cmp.Or(cmp.Compare(oldest[b], oldest[a]), strings.Compare(a[0], b[0]), strings.Compare(a[1], b[1]))
+	})
+	for _, key := range keys[:min(c.topN, len(keys))] {
+		ch <- prometheus.MustNewConstMetric(c.stuck, prometheus.GaugeValue, oldest[key], key[0], key[1])
+	}
+}
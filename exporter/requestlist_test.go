@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestParseRequest(t *testing.T) {
+	for line, want := range map[string]request{
+		"  0    A IN Example.com. 1.204000 iterator wait for 192.0.2.53": {
+			qtype: "A", qname: "example.com.", module: "iterator", state: "wait_reply", waiting: true, age: 1.204,
+		},
+		"  1   DS IN example. - validator wants DNSKEY IN example.": {
+			qtype: "DS", qname: "example.", module: "validator", state: "wait_subquery",
+		},
+		"  2 AAAA IN example.org. 0.012000 validator is module_wait_module": {
+			qtype: "AAAA", qname: "example.org.", module: "validator", state: "wait_module", waiting: true, age: 0.012,
+		},
+	} {
+		r, err := parseRequest(line)
+		if err != nil {
+			t.Errorf("%q: %s", line, err)
+		} else if r != want {
+			t.Errorf("%q: got %+v, expected %+v", line, r, want)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"  0    A IN example.com. 1.2 iterator",
+		"  0    A IN example.com. x iterator wait for 192.0.2.53",
+		"  0    A IN example.com. 1.2 iterator is",
+		"  0    A IN example.com. 1.2 iterator sleeps soundly",
+	} {
+		if _, err := parseRequest(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestRequestList(t *testing.T) {
+	dump, err := os.ReadFile("testdata/dump_requestlist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := unboundtest.Listen(t, unboundtest.Commands(t, map[string]string{"dump_requestlist": string(dump)}))
+	opts := Options{RequestList: &RequestListOptions{TopN: 2}}
+	exp, err := NewUnboundExporter(target, opts, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := gather(t, exp)
+
+	// Only the five queries with a client waiting have an age.
+	age := families["unbound_request_list_age_seconds"].GetMetric()
+	if len(age) != 1 || age[0].GetHistogram().GetSampleCount() != 5 ||
+		math.Abs(age[0].GetHistogram().GetSampleSum()-17.749) > 1e-9 ||
+		len(age[0].GetHistogram().GetBucket()) != len(requestListAgeBuckets) {
+		t.Errorf("unexpected age histogram %v", age)
+	}
+
+	queries := map[string]float64{}
+	for _, m := range families["unbound_request_list_queries"].GetMetric() {
+		queries[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	if len(queries) != 4 || queries["A"] != 3 || queries["DS"] != 1 {
+		t.Errorf("unexpected queries by type %v", queries)
+	}
+
+	states := map[string]float64{}
+	for _, m := range families["unbound_request_list_module_state"].GetMetric() {
+		states[m.GetLabel()[0].GetValue()+" "+m.GetLabel()[1].GetValue()] = m.GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"iterator wait_reply":     3,
+		"validator wait_subquery": 2,
+		"validator wait_module":   1,
+	}
+	if len(states) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, states)
+	}
+	for state, n := range expected {
+		if states[state] != n {
+			t.Errorf("%s: expected %v, got %v", state, n, states[state])
+		}
+	}
+
+	// The two names waited for the longest, with their oldest query.
+	stuck := map[string]float64{}
+	for _, m := range families["unbound_request_list_stuck_age_seconds"].GetMetric() {
+		stuck[m.GetLabel()[0].GetValue()+" "+m.GetLabel()[1].GetValue()] = m.GetGauge().GetValue()
+	}
+	if len(stuck) != 2 || stuck["slow.example.net. A"] != 12.003 || stuck["www.example.com. A"] != 4.512 {
+		t.Errorf("unexpected stuck queries %v", stuck)
+	}
+}
@@ -0,0 +1,395 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Unbound publishes its statistics in two SysV shared memory segments when
+// shm-enable is set: shm-key holds a ub_shm_stat_info, and shm-key+1 an array
+// of ub_stats_info, the sum over all threads followed by one per thread. The
+// structures below mirror those of libunbound/unbound.h in Unbound 1.24 on
+// 64-bit platforms. Unbound does not version them, so the segment sizes are
+// checked against these structures before anything is decoded.
+
+const (
+	shmQtypeNum     = 256
+	shmQclassNum    = 256
+	shmRcodeNum     = 16
+	shmOpcodeNum    = 16
+	shmBucketNum    = 40
+	shmRPZActionNum = 10
+)
+
+// shmStatInfo mirrors struct ub_shm_stat_info.
+type shmStatInfo struct {
+	NumThreads int32
+	_          [4]byte
+
+	NowSec, NowUsec         int64
+	UpSec, UpUsec           int64
+	ElapsedSec, ElapsedUsec int64
+
+	MemMsg                  int64
+	MemRRset                int64
+	MemVal                  int64
+	MemIter                 int64
+	MemSubnet               int64
+	MemIpsecmod             int64
+	MemRespip               int64
+	MemDNSCryptSharedSecret int64
+	MemDNSCryptNonce        int64
+	MemDynlib               int64
+}
+
+// shmServerStats mirrors struct ub_server_stats.
+type shmServerStats struct {
+	NumQueries               int64
+	NumQueriesIPRatelimited  int64
+	NumQueriesCookieValid    int64
+	NumQueriesCookieClient   int64
+	NumQueriesCookieInvalid  int64
+	NumQueriesDiscardTimeout int64
+	NumQueriesWaitLimit      int64
+	NumQueriesMissedCache    int64
+	NumQueriesPrefetch       int64
+	NumQueriesTimedOut       int64
+	MaxQueryTimeUs           int64
+	SumQueryListSize         int64
+	MaxQueryListSize         int64
+
+	Extended int32
+	_        [4]byte
+
+	Qtype     [shmQtypeNum]int64
+	QtypeBig  int64
+	Qclass    [shmQclassNum]int64
+	QclassBig int64
+	Qopcode   [shmOpcodeNum]int64
+
+	Qtcp         int64
+	QtcpOutgoing int64
+	QudpOutgoing int64
+	Qtls         int64
+	Qhttps       int64
+	Qipv6        int64
+
+	QbitQR, QbitAA, QbitTC, QbitRD int64
+	QbitRA, QbitZ, QbitAD, QbitCD  int64
+
+	QEDNS   int64
+	QEDNSDO int64
+
+	AnsRcode           [shmRcodeNum]int64
+	AnsRcodeNodata     int64
+	AnsSecure          int64
+	AnsBogus           int64
+	RRsetBogus         int64
+	QueriesRatelimited int64
+	UnwantedReplies    int64
+	UnwantedQueries    int64
+	TCPAcceptUsage     int64
+	AnsExpired         int64
+
+	Hist [shmBucketNum]int64
+
+	MsgCacheCount           int64
+	RRsetCacheCount         int64
+	InfraCacheCount         int64
+	KeyCacheCount           int64
+	MsgCacheMaxCollisions   int64
+	RRsetCacheMaxCollisions int64
+
+	NumQueryDNSCryptCrypted          int64
+	NumQueryDNSCryptCert             int64
+	NumQueryDNSCryptCleartext        int64
+	NumQueryDNSCryptCryptedMalformed int64
+	NumQueryDNSCryptSecretMissCache  int64
+	SharedSecretCacheCount           int64
+	NumQueryDNSCryptReplay           int64
+	NonceCacheCount                  int64
+
+	NumQueryAuthzoneUp   int64
+	NumQueryAuthzoneDown int64
+	NumNegCacheNoerror   int64
+	NumNegCacheNxdomain  int64
+	NumQuerySubnet       int64
+	NumQuerySubnetCache  int64
+	NumQueryCachedb      int64
+
+	MemStreamWait          int64
+	MemHTTP2QueryBuffer    int64
+	MemHTTP2ResponseBuffer int64
+	QtlsResume             int64
+	RPZAction              [shmRPZActionNum]int64
+	MemQUIC                int64
+	Qquic                  int64
+
+	NumQueriesReplyaddrLimit int64
+	NumDNSErrorReports       int64
+	ValOps                   int64
+}
+
+// shmStatsInfo mirrors struct ub_stats_info.
+type shmStatsInfo struct {
+	Svr shmServerStats
+
+	MeshNumStates         int64
+	MeshNumReplyStates    int64
+	MeshNumReplyAddrs     int64
+	MeshJostled           int64
+	MeshDropped           int64
+	MeshRepliesSent       int64
+	MeshRepliesSumWaitSec int64
+	MeshRepliesSumWaitUs  int64
+	MeshTimeMedian        float64
+}
+
+// rpzActionNames are the names of Unbound's enum rpz_action, in order.
+var rpzActionNames = [shmRPZActionNum]string{
+	"nxdomain", "nodata", "passthru", "drop", "tcp-only", "invalid",
+	"local-data", "disabled", "no-override", "cname-override",
+}
+
+// decodeShm decodes the contents of Unbound's two statistics segments into
+// the statistics stats_noreset would have printed.
+func decodeShm(ctl []byte, arr []byte) ([]stat, error) {
+	var info shmStatInfo
+	if len(ctl) != binary.Size(info) {
+		return nil, &scrapeError{reasonParse, fmt.Errorf(
+			"statistics control segment has %d bytes, expected %d for the supported Unbound version", len(ctl), binary.Size(info))}
+	}
+	err := binary.Read(bytes.NewReader(ctl), binary.NativeEndian, &info)
+	if err != nil {
+		return nil, &scrapeError{reasonParse, err}
+	}
+
+	expected := (int(info.NumThreads) + 1) * binary.Size(shmStatsInfo{})
+	if info.NumThreads < 0 || len(arr) != expected {
+		return nil, &scrapeError{reasonParse, fmt.Errorf(
+			"statistics segment has %d bytes, expected %d for %d threads of the supported Unbound version", len(arr), expected, info.NumThreads)}
+	}
+	threads := make([]shmStatsInfo, info.NumThreads+1)
+	err = binary.Read(bytes.NewReader(arr), binary.NativeEndian, threads)
+	if err != nil {
+		return nil, &scrapeError{reasonParse, err}
+	}
+
+	var p shmPrinter
+	for i := 1; i < len(threads); i++ {
+		p.thread(fmt.Sprintf("thread%d", i-1), &threads[i])
+	}
+	total := &threads[0]
+	p.thread("total", total)
+
+	p.add("time.now", seconds(info.NowSec, info.NowUsec))
+	p.add("time.up", seconds(info.UpSec, info.UpUsec))
+	p.add("time.elapsed", seconds(info.ElapsedSec, info.ElapsedUsec))
+
+	p.add("mem.cache.rrset", float64(info.MemRRset))
+	p.add("mem.cache.message", float64(info.MemMsg))
+	p.add("mem.mod.iterator", float64(info.MemIter))
+	p.add("mem.mod.validator", float64(info.MemVal))
+	p.add("mem.mod.respip", float64(info.MemRespip))
+	p.add("mem.mod.subnet", float64(info.MemSubnet))
+	p.add("mem.mod.ipsecmod", float64(info.MemIpsecmod))
+	p.add("mem.mod.dynlib", float64(info.MemDynlib))
+	p.add("mem.cache.dnscrypt_shared_secret", float64(info.MemDNSCryptSharedSecret))
+	p.add("mem.cache.dnscrypt_nonce", float64(info.MemDNSCryptNonce))
+	p.add("mem.streamwait", float64(total.Svr.MemStreamWait))
+	p.add("mem.http.query_buffer", float64(total.Svr.MemHTTP2QueryBuffer))
+	p.add("mem.http.response_buffer", float64(total.Svr.MemHTTP2ResponseBuffer))
+	p.add("mem.quic", float64(total.Svr.MemQUIC))
+
+	for i, bounds := range histogramBounds() {
+		p.add(fmt.Sprintf("histogram.%s.to.%s", bounds[0], bounds[1]), float64(total.Svr.Hist[i]))
+	}
+
+	if total.Svr.Extended != 0 {
+		p.extended(&total.Svr)
+	}
+	return p.stats, nil
+}
+
+func seconds(sec, usec int64) float64 {
+	return float64(sec) + float64(usec)/1e6
+}
+
+// histogramBounds returns the bounds of the buckets of Unbound's latency
+// histogram, formatted as in its statistics keys. The first bucket covers
+// up to one microsecond, and each following one doubles its upper bound,
+// except that the microseconds stop at one second.
+func histogramBounds() [shmBucketNum][2]string {
+	var bounds [shmBucketNum][2]string
+	var sec, usec int64
+	for i := range bounds {
+		lower := fmt.Sprintf("%06d.%06d", sec, usec)
+		switch {
+		case sec == 0 && usec == 0:
+			usec = 1
+		case sec == 0 && usec*2 < 1000000:
+			usec *= 2
+		case sec == 0:
+			sec, usec = 1, 0
+		default:
+			sec *= 2
+		}
+		bounds[i] = [2]string{lower, fmt.Sprintf("%06d.%06d", sec, usec)}
+	}
+	return bounds
+}
+
+// shmPrinter accumulates statistics in the order Unbound prints them.
+type shmPrinter struct {
+	stats []stat
+}
+
+func (p *shmPrinter) add(key string, value float64) {
+	p.stats = append(p.stats, stat{key, value})
+}
+
+// thread adds the per-thread statistics, under the name prefix.
+func (p *shmPrinter) thread(prefix string, s *shmStatsInfo) {
+	add := func(key string, value int64) {
+		p.add(prefix+"."+key, float64(value))
+	}
+	add("num.queries", s.Svr.NumQueries)
+	add("num.queries_ip_ratelimited", s.Svr.NumQueriesIPRatelimited)
+	add("num.queries_cookie_valid", s.Svr.NumQueriesCookieValid)
+	add("num.queries_cookie_client", s.Svr.NumQueriesCookieClient)
+	add("num.queries_cookie_invalid", s.Svr.NumQueriesCookieInvalid)
+	add("num.queries_discard_timeout", s.Svr.NumQueriesDiscardTimeout)
+	add("num.queries_replyaddr_limit", s.Svr.NumQueriesReplyaddrLimit)
+	add("num.queries_wait_limit", s.Svr.NumQueriesWaitLimit)
+	add("num.cachehits", s.Svr.NumQueries-s.Svr.NumQueriesMissedCache)
+	add("num.cachemiss", s.Svr.NumQueriesMissedCache)
+	add("num.prefetch", s.Svr.NumQueriesPrefetch)
+	add("num.queries_timed_out", s.Svr.NumQueriesTimedOut)
+	add("query.queue_time_us.max", s.Svr.MaxQueryTimeUs)
+	add("num.expired", s.Svr.AnsExpired)
+	add("num.recursivereplies", s.MeshRepliesSent)
+	add("num.dnscrypt.crypted", s.Svr.NumQueryDNSCryptCrypted)
+	add("num.dnscrypt.cert", s.Svr.NumQueryDNSCryptCert)
+	add("num.dnscrypt.cleartext", s.Svr.NumQueryDNSCryptCleartext)
+	add("num.dnscrypt.malformed", s.Svr.NumQueryDNSCryptCryptedMalformed)
+	add("num.dns_error_reports", s.Svr.NumDNSErrorReports)
+
+	requestListAvg := 0.0
+	if lookups := s.Svr.NumQueriesMissedCache + s.Svr.NumQueriesPrefetch; lookups > 0 {
+		requestListAvg = float64(s.Svr.SumQueryListSize) / float64(lookups)
+	}
+	p.add(prefix+".requestlist.avg", requestListAvg)
+	add("requestlist.max", s.Svr.MaxQueryListSize)
+	add("requestlist.overwritten", s.MeshJostled)
+	add("requestlist.exceeded", s.MeshDropped)
+	add("requestlist.current.all", s.MeshNumStates)
+	add("requestlist.current.user", s.MeshNumReplyStates)
+	add("requestlist.current.replies", s.MeshNumReplyAddrs)
+
+	recursionAvg := 0.0
+	if s.MeshRepliesSent > 0 {
+		recursionAvg = seconds(s.MeshRepliesSumWaitSec, s.MeshRepliesSumWaitUs) / float64(s.MeshRepliesSent)
+	}
+	p.add(prefix+".recursion.time.avg", recursionAvg)
+	p.add(prefix+".recursion.time.median", s.MeshTimeMedian)
+	add("tcpusage", s.Svr.TCPAcceptUsage)
+}
+
+// extended adds the statistics printed with extended-statistics enabled.
+// Like Unbound, it omits most codes that were never seen.
+func (p *shmPrinter) extended(s *shmServerStats) {
+	add := func(key string, value int64) {
+		p.add(key, float64(value))
+	}
+	addNonZero := func(key string, value int64) {
+		if value != 0 {
+			add(key, value)
+		}
+	}
+
+	for i, n := range s.Qtype {
+		addNonZero("num.query.type."+codeName(qtypeNames, "TYPE", i), n)
+	}
+	addNonZero("num.query.type.other", s.QtypeBig)
+	for i, n := range s.Qclass {
+		addNonZero("num.query.class."+codeName(qclassNames, "CLASS", i), n)
+	}
+	addNonZero("num.query.class.other", s.QclassBig)
+	for i, n := range s.Qopcode {
+		addNonZero("num.query.opcode."+codeName(opcodeNames, "OPCODE", i), n)
+	}
+
+	add("num.query.tcp", s.Qtcp)
+	add("num.query.tcpout", s.QtcpOutgoing)
+	add("num.query.udpout", s.QudpOutgoing)
+	add("num.query.tls", s.Qtls)
+	add("num.query.tls.resume", s.QtlsResume)
+	add("num.query.ipv6", s.Qipv6)
+	add("num.query.https", s.Qhttps)
+	add("num.query.quic", s.Qquic)
+
+	add("num.query.flags.QR", s.QbitQR)
+	add("num.query.flags.AA", s.QbitAA)
+	add("num.query.flags.TC", s.QbitTC)
+	add("num.query.flags.RD", s.QbitRD)
+	add("num.query.flags.RA", s.QbitRA)
+	add("num.query.flags.Z", s.QbitZ)
+	add("num.query.flags.AD", s.QbitAD)
+	add("num.query.flags.CD", s.QbitCD)
+	add("num.query.edns.present", s.QEDNS)
+	add("num.query.edns.DO", s.QEDNSDO)
+
+	for i, n := range s.AnsRcode {
+		// The common response codes are always printed.
+		if i <= 5 {
+			add("num.answer.rcode."+codeName(rcodeNames, "RCODE", i), n)
+		} else {
+			addNonZero("num.answer.rcode."+codeName(rcodeNames, "RCODE", i), n)
+		}
+	}
+	addNonZero("num.answer.rcode.nodata", s.AnsRcodeNodata)
+	add("num.query.ratelimited", s.QueriesRatelimited)
+	add("num.answer.secure", s.AnsSecure)
+	add("num.answer.bogus", s.AnsBogus)
+	add("num.rrset.bogus", s.RRsetBogus)
+	add("num.valops", s.ValOps)
+	add("num.query.aggressive.NOERROR", s.NumNegCacheNoerror)
+	add("num.query.aggressive.NXDOMAIN", s.NumNegCacheNxdomain)
+	add("unwanted.queries", s.UnwantedQueries)
+	add("unwanted.replies", s.UnwantedReplies)
+
+	add("msg.cache.count", s.MsgCacheCount)
+	add("rrset.cache.count", s.RRsetCacheCount)
+	add("infra.cache.count", s.InfraCacheCount)
+	add("key.cache.count", s.KeyCacheCount)
+	add("msg.cache.max_collisions", s.MsgCacheMaxCollisions)
+	add("rrset.cache.max_collisions", s.RRsetCacheMaxCollisions)
+	add("dnscrypt_shared_secret.cache.count", s.SharedSecretCacheCount)
+	add("dnscrypt_nonce.cache.count", s.NonceCacheCount)
+	add("num.query.dnscrypt.shared_secret.cachemiss", s.NumQueryDNSCryptSecretMissCache)
+	add("num.query.dnscrypt.replay", s.NumQueryDNSCryptReplay)
+	add("num.query.authzone.up", s.NumQueryAuthzoneUp)
+	add("num.query.authzone.down", s.NumQueryAuthzoneDown)
+	add("num.query.subnet", s.NumQuerySubnet)
+	add("num.query.subnet_cache", s.NumQuerySubnetCache)
+	add("num.query.cachedb", s.NumQueryCachedb)
+
+	for i, n := range s.RPZAction {
+		addNonZero("num.rpz.action.rpz-"+rpzActionNames[i], n)
+	}
+}
+
+// readShm reads Unbound's statistics from the shared memory segments at
+// key and key+1.
+func readShm(key int) ([]stat, error) {
+	ctl, err := readShmSegment(key)
+	if err != nil {
+		return nil, &scrapeError{reasonShm, err}
+	}
+	arr, err := readShmSegment(key + 1)
+	if err != nil {
+		return nil, &scrapeError{reasonShm, err}
+	}
+	return decodeShm(ctl, arr)
+}
@@ -0,0 +1,24 @@
+package exporter
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// readShmSegment returns a copy of the SysV shared memory segment with key,
+// which must already exist. It is attached read-only, and only for the time
+// it takes to copy it.
+func readShmSegment(key int) ([]byte, error) {
+	id, err := unix.SysvShmGet(key, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("shared memory segment %d: %w", key, err)
+	}
+	segment, err := unix.SysvShmAttach(id, 0, unix.SHM_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("attaching shared memory segment %d: %w", key, err)
+	}
+	defer func() { _ = unix.SysvShmDetach(segment) }()
+
+	return append([]byte(nil), segment...), nil
+}
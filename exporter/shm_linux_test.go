@@ -0,0 +1,110 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// createShmSegment creates a shared memory segment at key holding data, as
+// Unbound does with shm-enable.
+func createShmSegment(t *testing.T, key int, data any) {
+	t.Helper()
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.NativeEndian, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := unix.SysvShmGet(key, buf.Len(), unix.IPC_CREAT|unix.IPC_EXCL|0o600)
+	if err != nil {
+		t.Skipf("cannot create shared memory segment: %s", err)
+	}
+	t.Cleanup(func() { _, _ = unix.SysvShmCtl(id, unix.IPC_RMID, nil) })
+
+	segment, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(segment, buf.Bytes())
+	err = unix.SysvShmDetach(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadShm(t *testing.T) {
+	key := 0x75620000 + os.Getpid()%0x10000*2
+
+	info := shmStatInfo{
+		NumThreads: 2,
+		NowSec:     1763079408,
+		NowUsec:    500000,
+		UpSec:      89,
+		MemRRset:   114717,
+	}
+	threads := make([]shmStatsInfo, 3)
+	threads[1].Svr.NumQueries = 3
+	threads[1].Svr.NumQueriesMissedCache = 1
+	threads[2].Svr.NumQueries = 1
+	threads[0].Svr.NumQueries = 4
+	threads[0].Svr.NumQueriesMissedCache = 1
+	threads[0].Svr.Extended = 1
+	threads[0].Svr.Qtype[28] = 4
+	threads[0].Svr.AnsRcode[2] = 7
+	threads[0].Svr.Hist[20] = 2
+	createShmSegment(t, key, &info)
+	createShmSegment(t, key+1, threads)
+
+	stats, err := readShm(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, expected := range map[string]float64{
+		"thread0.num.queries":                      3,
+		"thread0.num.cachehits":                    2,
+		"thread1.num.queries":                      1,
+		"total.num.cachemiss":                      1,
+		"time.now":                                 1763079408.5,
+		"time.up":                                  89,
+		"mem.cache.rrset":                          114717,
+		"num.query.type.AAAA":                      4,
+		"num.answer.rcode.SERVFAIL":                7,
+		"num.answer.rcode.NOERROR":                 0,
+		"histogram.000000.524288.to.000001.000000": 2,
+	} {
+		if v := value(stats, k); v != expected {
+			t.Errorf("%s: expected %v, got %v", k, expected, v)
+		}
+	}
+	if v := value(stats, "num.answer.rcode.YXDOMAIN"); v != -1 {
+		t.Errorf("expected zero num.answer.rcode.YXDOMAIN to be omitted, got %v", v)
+	}
+
+	// The statistics feed the same metrics as the control socket's.
+	metrics := gatherStats(t, stats)
+	for _, name := range []string{"unbound_queries_total", "unbound_query_types_total", "unbound_response_time_seconds"} {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("expected metric %s", name)
+		}
+	}
+}
+
+func TestReadShmLayoutMismatch(t *testing.T) {
+	key := 0x75630000 + os.Getpid()%0x10000*2
+
+	createShmSegment(t, key, &shmStatInfo{NumThreads: 1})
+	createShmSegment(t, key+1, make([]int64, 10))
+
+	_, err := readShm(key)
+	if err == nil {
+		t.Fatal("expected a layout mismatch to be detected")
+	}
+	if reason := failureReason(t.Context(), err); reason != reasonParse {
+		t.Errorf("expected reason %q, got %q", reasonParse, reason)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package exporter
+
+import "errors"
+
+func readShmSegment(key int) ([]byte, error) {
+	return nil, errors.New("reading statistics from shared memory is only supported on Linux")
+}
@@ -0,0 +1,196 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// snapshot is the outcome of one round trip to Unbound's control socket.
+type snapshot struct {
+	stats []stat
+	err   error
+	trace scrapeTrace
+	// replies are the replies to the successful control commands.
+	replies []commandReply
+}
+
+var errNotPolled = errors.New("no poll of Unbound has completed yet")
+
+// errAbandoned cancels a round trip that no scrape waits for anymore.
+var errAbandoned = errors.New("every scrape stopped waiting for the round trip")
+
+// flight is a round trip to Unbound that concurrent scrapes can wait for.
+type flight struct {
+	done chan struct{}
+	snap snapshot
+	// waiters is the number of scrapes waiting for the round trip. The
+	// last one to give up cancels it, closing its connection.
+	waiters int
+	cancel  context.CancelCauseFunc
+}
+
+// scrape fetches Unbound's statistics. If a round trip is already in
+// progress, it waits for that one instead of starting another, so that
+// concurrent scrapes make Unbound aggregate its statistics only once. The
+// round trip is not tied to ctx, which only bounds how long this scrape
+// waits for it, unless no other scrape waits for it either.
+func (e *UnboundExporter) scrape(ctx context.Context) snapshot {
+	start := time.Now()
+	e.mu.Lock()
+	f := e.inflight
+	if f == nil {
+		flightCtx, cancel := context.WithCancelCause(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		e.inflight = f
+		go e.fly(flightCtx, f)
+	}
+	f.waiters++
+	e.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.snap
+	case <-ctx.Done():
+		reason := failureReason(ctx, ctx.Err())
+		e.log.Error("Gave up waiting for scrape", "reason", reason)
+		e.mu.Lock()
+		e.scrapeErrors[reason]++
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel(errAbandoned)
+			if e.inflight == f {
+				e.inflight = nil
+			}
+		}
+		e.mu.Unlock()
+		trace := scrapeTrace{reason: reason}
+		trace.fail(phaseWait, start)
+		return snapshot{err: ctx.Err(), trace: trace}
+	}
+}
+
+// maxRoundTrip bounds round trips when the exporter has no timeout, so that
+// a wedged Unbound cannot hold up every later scrape joining its round trip.
+var maxRoundTrip = time.Minute
+
+// fly makes the round trip of f under ctx, bounded by the exporter's
+// timeout rather than by the scrapes waiting for it, so that a scrape that
+// gives up early does not fail the others.
+func (e *UnboundExporter) fly(ctx context.Context, f *flight) {
+	defer f.cancel(nil)
+	timeout := e.timeout
+	if timeout <= 0 {
+		timeout = maxRoundTrip
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	f.snap = e.refresh(ctx)
+
+	e.mu.Lock()
+	if e.inflight == f {
+		e.inflight = nil
+	}
+	e.mu.Unlock()
+	close(f.done)
+}
+
+// refresh makes a round trip to Unbound and records its outcome.
+func (e *UnboundExporter) refresh(ctx context.Context) snapshot {
+	var stats []stat
+	var err error
+	var trace scrapeTrace
+	if e.socketFamily == "shm" {
+		start := time.Now()
+		stats, err = readShm(e.shmKey)
+		if err != nil {
+			trace.fail(phaseRead, start)
+		} else {
+			trace.phase(phaseRead, start)
+			trace.lines = len(stats)
+		}
+	} else {
+		stats, err = e.collectFromSocket(ctx, &trace)
+	}
+	if err != nil && errors.Is(context.Cause(ctx), errAbandoned) {
+		// The scrapes that gave up on it have already counted the failure.
+		e.log.Debug("Abandoned scrape", "phase", trace.failed, "err", err.Error())
+		return snapshot{err: err, trace: trace}
+	}
+	if err != nil {
+		reason := failureReason(ctx, err)
+		trace.reason = reason
+		e.log.Error("Failed to scrape socket", "reason", reason, "phase", trace.failed, "err", err.Error())
+		e.unboundUp.Store(false)
+		e.mu.Lock()
+		e.scrapeErrors[reason]++
+		e.mu.Unlock()
+		return snapshot{err: err, trace: trace}
+	}
+
+	if e.accumulator != nil {
+		stats, err = e.accumulator.apply(stats, e.metrics.isCounter)
+		if err != nil {
+			// The totals are still correct in memory, only not persisted.
+			e.log.Error("Failed to save counter totals", "err", err.Error())
+		}
+	}
+
+	replies := e.runCommands(ctx)
+
+	e.unboundUp.Store(true)
+	e.mu.Lock()
+	e.succeeded = time.Now()
+	e.mu.Unlock()
+	return snapshot{stats: stats, trace: trace, replies: replies}
+}
+
+// Poll scrapes Unbound every poll interval until ctx is done, keeping the
+// outcome for Collect to serve. It only has an effect in polling mode.
+func (e *UnboundExporter) Poll(ctx context.Context) {
+	if e.pollInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.pollInterval)
+	defer ticker.Stop()
+	for {
+		e.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *UnboundExporter) poll(ctx context.Context) {
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	snap := e.scrape(ctx)
+
+	e.mu.Lock()
+	e.polled = &snap
+	e.mu.Unlock()
+}
+
+// latest returns the outcome of the last poll.
+func (e *UnboundExporter) latest() snapshot {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.polled == nil {
+		return snapshot{err: errNotPolled}
+	}
+	return *e.polled
+}
+
+// lastSuccess returns the time of the last successful round trip, or the
+// zero time if there was none yet.
+func (e *UnboundExporter) lastSuccess() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.succeeded
+}
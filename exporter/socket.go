@@ -0,0 +1,123 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// dial connects to the control socket and completes the TLS handshake, if
+// any. The connection is closed as soon as ctx is done, and its deadline is
+// set to that of ctx, so that no read or write outlives the scrape. The
+// durations of the phases are recorded in trace.
+func (e *UnboundExporter) dial(ctx context.Context, trace *scrapeTrace) (net.Conn, error) {
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, e.socketFamily, e.host)
+	if err != nil {
+		trace.fail(phaseDial, start)
+		return nil, &scrapeError{reasonDial, err}
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	closeConn := func() {
+		stop()
+		conn.Close()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			closeConn()
+			trace.fail(phaseDial, start)
+			return nil, &scrapeError{reasonDial, err}
+		}
+	}
+	trace.phase(phaseDial, start)
+
+	if e.socketFamily != "unix" && e.tlsConfig != nil {
+		start = time.Now()
+		tlsConn := tls.Client(conn, e.tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			closeConn()
+			trace.fail(phaseTLS, start)
+			return nil, &scrapeError{reasonTLS, err}
+		}
+		conn = tlsConn
+		trace.phase(phaseTLS, start)
+
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			e.mu.Lock()
+			e.serverCert = certs[0]
+			e.mu.Unlock()
+		}
+	}
+
+	return &ctxConn{Conn: conn, stop: stop}, nil
+}
+
+// ctxConn is a connection tied to a context by context.AfterFunc.
+type ctxConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// collectFromSocket fetches Unbound's statistics over the control socket.
+// The reply is read in full before being parsed, so that the two can be
+// timed apart.
+func (e *UnboundExporter) collectFromSocket(ctx context.Context, trace *scrapeTrace) ([]stat, error) {
+	conn, err := e.dial(ctx, trace)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	_, err = conn.Write([]byte("UBCT1 stats_noreset\n"))
+	if err != nil {
+		trace.fail(phaseRead, start)
+		return nil, &scrapeError{reasonRead, err}
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		trace.fail(phaseRead, start)
+		return nil, &scrapeError{reasonRead, err}
+	}
+	trace.phase(phaseRead, start)
+	trace.bytes = len(reply)
+
+	start = time.Now()
+	stats, rejected, err := readStats(bytes.NewReader(reply), e.lenient)
+	e.countParseErrors(rejected)
+	if err != nil {
+		trace.fail(phaseParse, start)
+		return nil, err
+	}
+	trace.phase(phaseParse, start)
+	trace.lines = len(stats)
+	return stats, nil
+}
+
+// countParseErrors records the lines rejected by the parser. In lenient
+// mode they are logged here, as they do not fail the scrape.
+func (e *UnboundExporter) countParseErrors(rejected []*lineError) {
+	if len(rejected) == 0 {
+		return
+	}
+	e.mu.Lock()
+	for _, lineErr := range rejected {
+		e.parseErrors[lineErr.reason]++
+	}
+	e.mu.Unlock()
+	if e.lenient {
+		e.log.Warn("Skipped lines that could not be parsed", "count", len(rejected), "first", rejected[0].Error())
+	}
+}
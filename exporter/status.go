@@ -0,0 +1,154 @@
+package exporter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusCommand exports what Unbound's status command tells about the
+// server.
+type statusCommand struct {
+	buildInfo *prometheus.Desc
+	threads   *prometheus.Desc
+	verbosity *prometheus.Desc
+	processID *prometheus.Desc
+}
+
+func newStatusCommand(constLabels prometheus.Labels) *statusCommand {
+	return &statusCommand{
+		buildInfo: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "build_info"),
+			"Version and module stack of Unbound, from the status command. Always 1.",
+			[]string{"version", "modules"}, constLabels),
+		threads: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "threads"),
+			"Number of threads of Unbound, from the status command.",
+			nil, constLabels),
+		verbosity: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "verbosity"),
+			"Verbosity level of Unbound, from the status command.",
+			nil, constLabels),
+		processID: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "process_id"),
+			"Process ID of Unbound, from the status command.",
+			nil, constLabels),
+	}
+}
+
+func (c *statusCommand) command() string {
+	return "status"
+}
+
+func (c *statusCommand) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.buildInfo
+	ch <- c.threads
+	ch <- c.verbosity
+	ch <- c.processID
+}
+
+func (c *statusCommand) parse(r io.Reader) (commandReply, error) {
+	status, err := parseStatus(r)
+	if err != nil {
+		return nil, err
+	}
+	status.cmd = c
+	return status, nil
+}
+
+// serverStatus is the reply to the status command.
+type serverStatus struct {
+	cmd       *statusCommand
+	version   string
+	verbosity int
+	threads   int
+	modules   []string
+	pid       int
+}
+
+var pidPattern = regexp.MustCompile(`^unbound \(pid (\d+)\) is running`)
+
+// parseStatus parses the reply to Unbound's status command:
+//
+//	version: 1.22.0
+//	verbosity: 1
+//	threads: 4
+//	modules: 2 [ validator iterator ]
+//	uptime: 1234 seconds
+//	options: reuseport control(ssl)
+//	unbound (pid 1234) is running...
+//
+// The uptime is left out, as it is exported from the statistics.
+func parseStatus(r io.Reader) (*serverStatus, error) {
+	var status serverStatus
+	var err error
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "error ") {
+			return nil, &scrapeError{reasonUnbound, errors.New(line)}
+		}
+		if matches := pidPattern.FindStringSubmatch(line); matches != nil {
+			status.pid, err = strconv.Atoi(matches[1])
+			if err != nil {
+				return nil, &scrapeError{reasonParse, fmt.Errorf("%q: %w", line, err)}
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "version":
+			status.version = value
+		case "verbosity":
+			status.verbosity, err = strconv.Atoi(value)
+		case "threads":
+			status.threads, err = strconv.Atoi(value)
+		case "modules":
+			_, list, _ := strings.Cut(value, "[")
+			list, _, _ = strings.Cut(list, "]")
+			status.modules = strings.Fields(list)
+		}
+		if err != nil {
+			return nil, &scrapeError{reasonParse, fmt.Errorf("%q: %w", line, err)}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &scrapeError{reasonRead, err}
+	}
+	if status.version == "" {
+		return nil, &scrapeError{reasonParse, errors.New("no version in status reply")}
+	}
+	return &status, nil
+}
+
+func (s *serverStatus) collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(
+		s.cmd.buildInfo,
+		prometheus.GaugeValue,
+		1,
+		s.version, strings.Join(s.modules, " "))
+	ch <- prometheus.MustNewConstMetric(
+		s.cmd.threads,
+		prometheus.GaugeValue,
+		float64(s.threads))
+	ch <- prometheus.MustNewConstMetric(
+		s.cmd.verbosity,
+		prometheus.GaugeValue,
+		float64(s.verbosity))
+	if s.pid != 0 {
+		ch <- prometheus.MustNewConstMetric(
+			s.cmd.processID,
+			prometheus.GaugeValue,
+			float64(s.pid))
+	}
+}
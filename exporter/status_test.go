@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+const statusReply = `version: 1.22.0
+verbosity: 1
+threads: 4
+modules: 3 [ subnetcache validator iterator ]
+uptime: 1234 seconds
+options: reuseport control(ssl)
+unbound (pid 4321) is running...
+`
+
+func TestParseStatus(t *testing.T) {
+	status, err := parseStatus(strings.NewReader(statusReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.version != "1.22.0" || status.verbosity != 1 || status.threads != 4 || status.pid != 4321 ||
+		strings.Join(status.modules, " ") != "subnetcache validator iterator" {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	for _, reply := range []string{
+		"error command not allowed\n",
+		"version: 1.22.0\nthreads: four\n",
+		"total.num.queries=4\n",
+	} {
+		_, err = parseStatus(strings.NewReader(reply))
+		if err == nil {
+			t.Errorf("%q: expected an error", reply)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	target := unboundtest.Listen(t, unboundtest.Commands(t, map[string]string{"status": statusReply}))
+	exp, err := NewUnboundExporter(target, Options{Status: true}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := gather(t, exp)
+	info := families["unbound_build_info"].GetMetric()
+	if len(info) != 1 || info[0].GetLabel()[0].GetValue() != "subnetcache validator iterator" || info[0].GetLabel()[1].GetValue() != "1.22.0" {
+		t.Errorf("unexpected build info %v", info)
+	}
+	if threads := families["unbound_threads"].GetMetric()[0].GetGauge().GetValue(); threads != 4 {
+		t.Errorf("expected 4 threads, got %v", threads)
+	}
+	if pid := families["unbound_process_id"].GetMetric()[0].GetGauge().GetValue(); pid != 4321 {
+		t.Errorf("expected pid 4321, got %v", pid)
+	}
+
+	// A refused status command leaves out the build info, but does not
+	// fail the scrape.
+	target = unboundtest.Listen(t, unboundtest.Commands(t, map[string]string{"status": "error command not allowed\n"}))
+	exp, err = NewUnboundExporter(target, Options{Status: true}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	families = gather(t, exp)
+	if families["unbound_build_info"] != nil {
+		t.Error("build info exported although the status command was refused")
+	}
+	if up := families["unbound_up"].GetMetric()[0].GetGauge().GetValue(); up != 1 {
+		t.Errorf("expected unbound_up 1, got %v", up)
+	}
+}
+
+// TestStatusFailureLogging checks that a failing command is logged again
+// after it succeeded in between.
+func TestStatusFailureLogging(t *testing.T) {
+	var reply atomic.Value
+	target := unboundtest.Listen(t, unboundtest.Serve(t, func(command string) (string, bool) {
+		return reply.Load().(string), command == "status"
+	}))
+	var logs bytes.Buffer
+	exp, err := NewUnboundExporter(target, Options{Status: true}, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, step := range []struct {
+		reply    string
+		failures int
+	}{
+		{"error command not allowed\n", 1},
+		{"error command not allowed\n", 1},
+		{statusReply, 1},
+		{"error command not allowed\n", 2},
+	} {
+		reply.Store(step.reply)
+		gather(t, exp)
+		if n := strings.Count(logs.String(), "Control command failed"); n != step.failures {
+			t.Errorf("step %d: expected %d failures logged, got %d", i, step.failures, n)
+		}
+	}
+}
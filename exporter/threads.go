@@ -0,0 +1,82 @@
+package exporter
+
+import "strings"
+
+// Thread modes select how statistics that Unbound reports both per thread,
+// as threadN.num.queries, and summed over threads, as total.num.queries, are
+// exported.
+const (
+	// ThreadModePerThread exports the per-thread statistics, with a thread
+	// label.
+	ThreadModePerThread = "per-thread"
+	// ThreadModeTotal exports the sums under the same names, without the
+	// thread label, so that the number of series does not grow with
+	// num-threads.
+	ThreadModeTotal = "total"
+	// ThreadModeBoth exports the per-thread statistics, and the sums under
+	// names prefixed with total_, such as unbound_total_queries_total.
+	ThreadModeBoth = "both"
+)
+
+// perThreadPrefixes are the ways patterns of per-thread statistics start.
+var perThreadPrefixes = []string{`^thread(\d+)\.`, `^thread([0-9]+)\.`}
+
+// threadTable adapts table to the thread mode.
+func threadTable(table []metricDescription, mode string) []metricDescription {
+	if mode == "" || mode == ThreadModePerThread {
+		return table
+	}
+
+	patterns := make(map[string]bool, len(table))
+	for _, md := range table {
+		patterns[md.pattern] = true
+	}
+
+	var adapted, totals []metricDescription
+	for _, md := range table {
+		total, ok := totalMetric(md)
+		if !ok {
+			adapted = append(adapted, md)
+			continue
+		}
+		// Some sums, such as total.recursion.time.avg, already have a
+		// metric of their own.
+		if patterns[total.pattern] {
+			if mode == ThreadModeBoth {
+				adapted = append(adapted, md)
+			}
+			continue
+		}
+		switch mode {
+		case ThreadModeTotal:
+			adapted = append(adapted, total)
+		case ThreadModeBoth:
+			adapted = append(adapted, md)
+			total.name = "total_" + total.name
+			if total.alias != nil {
+				alias := *total.alias
+				alias.name = "total_" + alias.name
+				total.alias = &alias
+			}
+			totals = append(totals, total)
+		}
+	}
+	return append(adapted, totals...)
+}
+
+// totalMetric returns the metric of the total.* sum of the per-thread
+// statistics of md, if they are per-thread statistics.
+func totalMetric(md metricDescription) (metricDescription, bool) {
+	if len(md.labels) == 0 || md.labels[0] != "thread" {
+		return md, false
+	}
+	for _, prefix := range perThreadPrefixes {
+		if rest, ok := strings.CutPrefix(md.pattern, prefix); ok {
+			md.pattern = `^total\.` + rest
+			md.labels = md.labels[1:]
+			md.zeroFill = nil
+			return md, true
+		}
+	}
+	return md, false
+}
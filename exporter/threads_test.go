@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestThreadMode(t *testing.T) {
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+	for _, tc := range []struct {
+		mode      string
+		perThread bool
+		total     string
+	}{
+		{ThreadModePerThread, true, ""},
+		{ThreadModeTotal, false, "unbound_queries_total"},
+		{ThreadModeBoth, true, "unbound_total_queries_total"},
+	} {
+		exp, err := NewUnboundExporter(target, Options{ThreadMode: tc.mode, Unmapped: UnmappedStat}, promslog.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		families := gather(t, exp)
+
+		perThread := false
+		for _, m := range families["unbound_queries_total"].GetMetric() {
+			perThread = perThread || len(m.GetLabel()) > 0
+		}
+		if families["unbound_thread_recursion_time_seconds_avg"] != nil {
+			perThread = true
+		}
+		if perThread != tc.perThread {
+			t.Errorf("%s: expected per-thread metrics %v, got %v", tc.mode, tc.perThread, perThread)
+		}
+
+		if tc.total != "" {
+			metrics := families[tc.total].GetMetric()
+			if len(metrics) != 1 || len(metrics[0].GetLabel()) != 0 || metrics[0].GetCounter().GetValue() != 4 {
+				t.Errorf("%s: expected %s 4 without labels, got %v", tc.mode, tc.total, metrics)
+			}
+		}
+
+		// Whichever of the per-thread statistics and their sums is not
+		// exported is not reported as unmapped either.
+		for _, m := range families["unbound_stat"].GetMetric() {
+			switch key := m.GetLabel()[0].GetValue(); key {
+			case "thread0.num.queries", "total.num.queries", "thread0.recursion.time.avg":
+				t.Errorf("%s: mapped statistic %s reported as unmapped", tc.mode, key)
+			}
+		}
+	}
+
+	_, err := NewUnboundExporter(target, Options{ThreadMode: "bogus"}, promslog.NewNopLogger())
+	if err == nil {
+		t.Error("unknown thread mode accepted")
+	}
+}
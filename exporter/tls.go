@@ -0,0 +1,289 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverName is the name Unbound's server certificate is verified against,
+// as unbound-control does.
+const serverName = "unbound"
+
+// TLSCredentials is the TLS material used to connect to Unbound's control
+// channel: the CA that Unbound's server certificate must chain to, and the
+// client certificate and key presented to Unbound.
+//
+// The files are re-read whenever their modification time or size changes,
+// which is checked on every connection, and when Reload is called. A failed
+// reload keeps the previous material in use. TLSCredentials is also a
+// collector for metrics about reloads.
+type TLSCredentials struct {
+	name          string
+	ca, cert, key string
+	log           *slog.Logger
+
+	mu          sync.Mutex
+	roots       *x509.CertPool
+	caCerts     []*x509.Certificate
+	keyPair     *tls.Certificate
+	versions    [3]fileVersion
+	lastSuccess time.Time
+	failures    float64
+
+	lastSuccessDesc *prometheus.Desc
+	failuresDesc    *prometheus.Desc
+	notAfterDesc    *prometheus.Desc
+}
+
+// fileVersion identifies the contents of a file cheaply.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewTLSCredentials loads the CA, certificate and key at the given paths.
+// name identifies the credentials in metrics and logs. If all three paths
+// are empty, it returns nil, meaning a plaintext connection.
+func NewTLSCredentials(name, ca, cert, key string, log *slog.Logger) (*TLSCredentials, error) {
+	if ca == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+
+	labels := prometheus.Labels{"profile": name}
+	c := &TLSCredentials{
+		name: name,
+		ca:   ca,
+		cert: cert,
+		key:  key,
+		log:  log.With("profile", name),
+		lastSuccessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "control_tls", "last_reload_success_timestamp_seconds"),
+			"Time the control channel TLS credentials were last loaded successfully, in seconds since 1970.",
+			nil, labels),
+		failuresDesc: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "control_tls", "reload_failures_total"),
+			"Number of failed reloads of the control channel TLS credentials.",
+			nil, labels),
+		notAfterDesc: newCertNotAfterDesc(labels),
+	}
+
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the files, regardless of whether they changed.
+func (c *TLSCredentials) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reloadLocked()
+}
+
+func (c *TLSCredentials) reloadLocked() error {
+	// Files that fail to load are not retried until they change again.
+	c.versions = c.stat()
+	err := c.load()
+	if err != nil {
+		c.failures++
+		return fmt.Errorf("loading TLS credentials %q: %w", c.name, err)
+	}
+	c.lastSuccess = time.Now()
+	return nil
+}
+
+// stat returns the current versions of the files. Missing files have the
+// zero version.
+func (c *TLSCredentials) stat() [3]fileVersion {
+	var versions [3]fileVersion
+	for i, path := range []string{c.ca, c.cert, c.key} {
+		fi, err := os.Stat(path)
+		if err == nil {
+			versions[i] = fileVersion{fi.ModTime(), fi.Size()}
+		}
+	}
+	return versions
+}
+
+func (c *TLSCredentials) load() error {
+	// Server authentication
+	caData, err := os.ReadFile(c.ca)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caData) {
+		return fmt.Errorf("failed to parse CA %s", c.ca)
+	}
+	// The pool does not give its certificates back, so they are parsed
+	// again for their expiry metrics.
+	caCerts := parseCertificates(caData)
+
+	// Client authentication
+	certData, err := os.ReadFile(c.cert)
+	if err != nil {
+		return err
+	}
+
+	keyData, err := os.ReadFile(c.key)
+	if err != nil {
+		return err
+	}
+
+	keyPair, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return fmt.Errorf("loading %s and %s: %w", c.cert, c.key, err)
+	}
+
+	c.roots = roots
+	c.caCerts = caCerts
+	c.keyPair = &keyPair
+	return nil
+}
+
+// current returns the material to use for a new connection, reloading it
+// first if the files changed since they were last loaded.
+func (c *TLSCredentials) current() (*x509.CertPool, *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stat() != c.versions {
+		err := c.reloadLocked()
+		if err != nil {
+			c.log.Error("Failed to reload TLS credentials, using the previous ones", "err", err.Error())
+		} else {
+			c.log.Info("Reloaded TLS credentials")
+		}
+	}
+	return c.roots, c.keyPair
+}
+
+// Config returns a TLS configuration that always uses the current
+// credentials. It returns nil for nil credentials.
+func (c *TLSCredentials) Config() *tls.Config {
+	if c == nil {
+		return nil
+	}
+	return &tls.Config{
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, keyPair := c.current()
+			return keyPair, nil
+		},
+		// The roots can change between connections, so the server
+		// certificate is verified by VerifyPeerCertificate below instead
+		// of with a fixed RootCAs.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			roots, _ := c.current()
+			return verifyServerCertificate(rawCerts, roots)
+		},
+	}
+}
+
+// verifyServerCertificate does what crypto/tls would do with RootCAs set to
+// roots and ServerName set to serverName.
+func verifyServerCertificate(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	})
+	return err
+}
+
+// newCertNotAfterDesc returns the descriptor of the certificate expiry
+// metric. Certificates loaded from files and those presented by Unbound
+// share it, distinguished by their role.
+func newCertNotAfterDesc(constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName("unbound", "control", "cert_not_after_seconds"),
+		"Expiry time of a control channel certificate, in seconds since 1970. The role is ca or client for the certificates loaded by the exporter, and server for the one presented by Unbound.",
+		[]string{"role", "subject", "serial"}, constLabels)
+}
+
+// certNotAfter returns the expiry metric of cert.
+func certNotAfter(desc *prometheus.Desc, role string, cert *x509.Certificate) prometheus.Metric {
+	return prometheus.MustNewConstMetric(
+		desc,
+		prometheus.GaugeValue,
+		float64(cert.NotAfter.Unix()),
+		role,
+		cert.Subject.String(),
+		fmt.Sprintf("%x", cert.SerialNumber))
+}
+
+// parseCertificates returns the certificates in PEM data, skipping any
+// that fail to parse.
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func (c *TLSCredentials) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lastSuccessDesc
+	ch <- c.failuresDesc
+	ch <- c.notAfterDesc
+}
+
+func (c *TLSCredentials) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	lastSuccess, failures := c.lastSuccess, c.failures
+	caCerts, keyPair := c.caCerts, c.keyPair
+	c.mu.Unlock()
+
+	for _, cert := range caCerts {
+		ch <- certNotAfter(c.notAfterDesc, "ca", cert)
+	}
+	if keyPair != nil && keyPair.Leaf != nil {
+		ch <- certNotAfter(c.notAfterDesc, "client", keyPair.Leaf)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.lastSuccessDesc,
+		prometheus.GaugeValue,
+		float64(lastSuccess.UnixNano())/1e9)
+	ch <- prometheus.MustNewConstMetric(
+		c.failuresDesc,
+		prometheus.CounterValue,
+		failures)
+}
@@ -0,0 +1,308 @@
+package exporter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+)
+
+// testCert is a certificate and its key, in PEM.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate for name, signed by parent or self-signed
+// if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, notAfter time.Time) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeFile writes data to path and moves its modification time forward,
+// so that the change is noticed even within the file system's timestamp
+// granularity.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	err := os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Duration(len(data)) * time.Second)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsUnbound is a TLS server standing in for Unbound's control channel,
+// requiring client certificates signed by clientCA.
+func tlsUnbound(t *testing.T, server *testCert, clientCA *testCert) string {
+	t.Helper()
+	keyPair, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// handshake connects to addr and reads the server's greeting, which fails
+// if the server rejected the client certificate.
+func handshake(addr string, cfg *tls.Config) error {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 2))
+	return err
+}
+
+func TestTLSCredentialsReload(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, time.Now().Add(time.Hour))
+	server := newTestCert(t, serverName, ca, time.Now().Add(time.Hour))
+	client := newTestCert(t, "client", ca, time.Now().Add(time.Hour))
+	otherCA := newTestCert(t, "other", nil, time.Now().Add(time.Hour))
+	untrusted := newTestCert(t, "client", otherCA, time.Now().Add(time.Hour))
+	addr := tlsUnbound(t, server, ca)
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "unbound_server.pem")
+	certPath := filepath.Join(dir, "unbound_control.pem")
+	keyPath := filepath.Join(dir, "unbound_control.key")
+	writeFile(t, caPath, ca.certPEM)
+	writeFile(t, certPath, client.certPEM)
+	writeFile(t, keyPath, client.keyPEM)
+
+	creds, err := NewTLSCredentials("default", caPath, certPath, keyPath, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := creds.Config()
+	err = handshake(addr, cfg)
+	if err != nil {
+		t.Fatalf("handshake with initial credentials: %s", err)
+	}
+
+	// A broken certificate is not loaded, and the previous one stays in use.
+	writeFile(t, certPath, []byte("garbage"))
+	err = handshake(addr, cfg)
+	if err != nil {
+		t.Fatalf("handshake after failed reload: %s", err)
+	}
+	if creds.failures != 1 {
+		t.Errorf("expected 1 reload failure, got %v", creds.failures)
+	}
+
+	// A changed certificate is picked up by the next connection.
+	writeFile(t, certPath, untrusted.certPEM)
+	writeFile(t, keyPath, untrusted.keyPEM)
+	err = handshake(addr, cfg)
+	if err == nil {
+		t.Fatal("expected the server to reject the reloaded, untrusted certificate")
+	}
+
+	writeFile(t, certPath, client.certPEM)
+	writeFile(t, keyPath, client.keyPEM)
+	err = creds.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handshake(addr, cfg)
+	if err != nil {
+		t.Fatalf("handshake after reload: %s", err)
+	}
+}
+
+func TestTLSCredentialsVerifyServer(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, time.Now().Add(time.Hour))
+	otherCA := newTestCert(t, "other", nil, time.Now().Add(time.Hour))
+	client := newTestCert(t, "client", ca, time.Now().Add(time.Hour))
+
+	for name, server := range map[string]*testCert{
+		"untrusted CA": newTestCert(t, serverName, otherCA, time.Now().Add(time.Hour)),
+		"wrong name":   newTestCert(t, "resolver", ca, time.Now().Add(time.Hour)),
+		"expired":      newTestCert(t, serverName, ca, time.Now().Add(-time.Minute)),
+	} {
+		addr := tlsUnbound(t, server, ca)
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "ca"), ca.certPEM)
+		writeFile(t, filepath.Join(dir, "cert"), client.certPEM)
+		writeFile(t, filepath.Join(dir, "key"), client.keyPEM)
+		creds, err := NewTLSCredentials("default", filepath.Join(dir, "ca"), filepath.Join(dir, "cert"), filepath.Join(dir, "key"), promslog.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = handshake(addr, creds.Config())
+		if err == nil {
+			t.Errorf("%s: expected server certificate to be rejected", name)
+		}
+	}
+}
+
+func TestTLSCredentialsErrors(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, time.Now().Add(time.Hour))
+	client := newTestCert(t, "client", ca, time.Now().Add(time.Hour))
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ca"), ca.certPEM)
+	writeFile(t, filepath.Join(dir, "cert"), client.certPEM)
+	writeFile(t, filepath.Join(dir, "key"), client.keyPEM)
+	writeFile(t, filepath.Join(dir, "garbage"), []byte("garbage"))
+
+	// The errors name the file that failed to load.
+	for _, files := range [][3]string{
+		{"garbage", "cert", "key"},
+		{"ca", "garbage", "key"},
+		{"ca", "cert", "missing"},
+	} {
+		var paths [3]string
+		for i, file := range files {
+			paths[i] = filepath.Join(dir, file)
+		}
+		_, err := NewTLSCredentials("default", paths[0], paths[1], paths[2], promslog.NewNopLogger())
+		if err == nil {
+			t.Errorf("%v: expected an error", files)
+			continue
+		}
+		bad := filepath.Join(dir, "garbage")
+		if files[2] == "missing" {
+			bad = paths[2]
+		}
+		if !strings.Contains(err.Error(), bad) {
+			t.Errorf("%v: expected the error to name %s, got %s", files, bad, err)
+		}
+	}
+}
+
+func TestCertNotAfter(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, time.Now().Add(3*time.Hour))
+	server := newTestCert(t, serverName, ca, time.Now().Add(2*time.Hour))
+	client := newTestCert(t, "client", ca, time.Now().Add(time.Hour))
+	addr := tlsUnbound(t, server, ca)
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ca"), ca.certPEM)
+	writeFile(t, filepath.Join(dir, "cert"), client.certPEM)
+	writeFile(t, filepath.Join(dir, "key"), client.keyPEM)
+	creds, err := NewTLSCredentials("default", filepath.Join(dir, "ca"), filepath.Join(dir, "cert"), filepath.Join(dir, "key"), promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake server does not speak the control protocol, so the scrape
+	// fails, but only after the handshake.
+	exp, err := NewUnboundExporter("tcp://"+addr, Options{TLSConfig: creds.Config()}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(creds)
+	credsFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := gather(t, exp)["unbound_control_cert_not_after_seconds"].GetMetric()
+	for _, mf := range credsFamilies {
+		if mf.GetName() == "unbound_control_cert_not_after_seconds" {
+			metrics = append(metrics, mf.GetMetric()...)
+		}
+	}
+
+	got := map[string]float64{}
+	for _, m := range metrics {
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		got[labels["role"]+" "+labels["subject"]+" "+labels["serial"]] = m.GetGauge().GetValue()
+	}
+	for role, cert := range map[string]*testCert{"ca": ca, "client": client, "server": server} {
+		key := fmt.Sprintf("%s CN=%s %x", role, cert.cert.Subject.CommonName, cert.cert.SerialNumber)
+		if got[key] != float64(cert.cert.NotAfter.Unix()) {
+			t.Errorf("expected %s to expire at %d, got %v", key, cert.cert.NotAfter.Unix(), got[key])
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("expected 3 certificates, got %v", got)
+	}
+}
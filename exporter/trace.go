@@ -0,0 +1,54 @@
+package exporter
+
+import "time"
+
+// Phases of a round trip to Unbound, as timed by
+// unbound_exporter_scrape_duration_seconds.
+const (
+	phaseDial  = "dial"
+	phaseTLS   = "tls"
+	phaseRead  = "read"
+	phaseParse = "parse"
+	// phaseWait is the time a scrape waited for a round trip it gave up
+	// on.
+	phaseWait = "wait"
+)
+
+// scrapeErrorReasons are the reasons for failed round trips counted by
+// unbound_exporter_scrape_errors_total, besides unknown ones.
+var scrapeErrorReasons = []string{
+	reasonDial, reasonTLS, reasonTimeout, reasonCanceled, reasonRead,
+	reasonParse, reasonShm, reasonUnbound,
+}
+
+// scrapeTrace records how a round trip to Unbound went. A nil trace
+// records nothing.
+type scrapeTrace struct {
+	phases    []string
+	durations []time.Duration
+	// bytes is the size of Unbound's reply.
+	bytes int
+	// lines is the number of statistics parsed from the reply.
+	lines int
+	// failed is the phase the round trip failed in, if it did, and reason
+	// why.
+	failed, reason string
+}
+
+// phase records that the named phase started at start and just ended.
+func (t *scrapeTrace) phase(name string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.phases = append(t.phases, name)
+	t.durations = append(t.durations, time.Since(start))
+}
+
+// fail records that the named phase started at start and just failed.
+func (t *scrapeTrace) fail(name string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.phase(name, start)
+	t.failed = name
+}
@@ -2,20 +2,21 @@ package exporter
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
 	"net/url"
-	"os"
 	"regexp"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -26,549 +27,549 @@ type metricDescription struct {
 	valueType   prometheus.ValueType
 	labels      []string
 	pattern     string
+	// scale multiplies the values of the statistics, to convert them to
+	// base units. Zero means 1.
+	scale float64
+	// family groups related metrics, for selection with collect[].
+	family string
+	// zeroFill lists values of the only label that are exported as zero
+	// when Unbound omits them, if enabled.
+	zeroFill []string
+	// v2 is the v2 name and type of the metric, if they differ, and alias
+	// a second name and type to export the metric as. See namingTable.
+	v2    *metricRename
+	alias *metricRename
 }
 
+type unboundMetric struct {
+	name   string
+	labels []string
+	// outputs are the metrics the statistics are exported as: one, or two
+	// during a migration to new names. The NameFilter removes outputs.
+	outputs []metricOutput
+	// counter is true if every output is a counter.
+	counter bool
+	pattern *regexp.Regexp
+	scale   float64
+	family  string
+	// guarded is true for metrics with a label subject to a LabelLimit.
+	guarded bool
+	// translate is true for metrics whose numeric DNS codes are replaced
+	// by their mnemonic, those that are guarded or zero-filled.
+	translate bool
+	// zeroFill lists the label values exported as zero when missing, if
+	// Options.ZeroFill is set.
+	zeroFill []string
+}
+
+// metricOutput is a metric a statistic is exported as.
+type metricOutput struct {
+	name      string
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}
+
+// names returns the names the metric is known by: its own, and those of its
+// outputs.
+func (metric *unboundMetric) names() []string {
+	names := []string{metric.name}
+	for _, o := range metric.outputs {
+		names = append(names, o.name)
+	}
+	return names
+}
+
+// enabled reports whether the metric has any output left.
+func (metric *unboundMetric) enabled() bool {
+	return len(metric.outputs) > 0
+}
+
+// send exports a value of the metric under each of its outputs.
+func (metric *unboundMetric) send(ch chan<- prometheus.Metric, value float64, labels ...string) {
+	for _, o := range metric.outputs {
+		ch <- prometheus.MustNewConstMetric(o.desc, o.valueType, value, labels...)
+	}
+}
+
+// metricSet holds the descriptors exported for one Unbound instance. The
+// descriptors of different instances only differ in their constant labels.
+type metricSet struct {
+	up          *prometheus.Desc
+	histogram   *prometheus.Desc
+	lastSuccess *prometheus.Desc
+	resets      *prometheus.Desc
+	parseErrors *prometheus.Desc
+	serverCert  *prometheus.Desc
+	metrics     []unboundMetric
+
+	// Metrics about the round trips to Unbound.
+	scrapeDuration *prometheus.Desc
+	scrapeErrors   *prometheus.Desc
+	scrapeFailure  *prometheus.Desc
+	replyBytes     *prometheus.Desc
+	linesParsed    *prometheus.Desc
+	linesMatched   *prometheus.Desc
+
+	matcher *keyMatcher
+
+	// guards apply the label limits, by label name.
+	guards       map[string]*labelGuard
+	foldedValues *prometheus.Desc
+
+	// responseTime is false if the NameFilter leaves out the histogram.
+	responseTime bool
+	// histogramMode selects the representation of the histogram.
+	histogramMode       string
+	sum                 *sumTracker
+	sumCorrections      *prometheus.Desc
+	quantiles           []float64
+	responseTimeSummary *prometheus.Desc
+
+	// unmapped is how statistics matching none of metrics are exported.
+	unmapped     string
+	unmappedKeys *prometheus.Desc
+	stat         *prometheus.Desc
+	constLabels  prometheus.Labels
+	// names holds the names of the mapped metrics, which unmapped
+	// statistics must not take over.
+	names map[string]bool
+	// sanitized caches the descriptors of unmapped statistics exported
+	// under a name of their own, keyed by that name and their label names.
+	// sanitizedNames holds the same key by name alone, for the first
+	// statistic exported under the name, and conflicts the keys skipped
+	// because their name was taken, so that they are logged once.
+	sanitized      sync.Map
+	sanitizedNames sync.Map
+	conflicts      sync.Map
+	log            *slog.Logger
+}
+
+// compileMetrics prepares the metrics of table for an Unbound instance.
+func compileMetrics(table []metricDescription, constLabels prometheus.Labels) *metricSet {
+	metrics := make([]unboundMetric, 0, len(table))
+	names := make(map[string]bool, len(table))
+
+	for _, md := range table {
+		metric := unboundMetric{
+			name:    prometheus.BuildFQName("unbound", "", md.name),
+			labels:  md.labels,
+			counter: true,
+			pattern: regexp.MustCompile(md.pattern),
+			scale:   md.scale,
+			family:  md.family,
+		}
+		renames := []metricRename{{md.name, md.valueType, md.description}}
+		if md.alias != nil {
+			renames = append(renames, *md.alias)
+		}
+		for _, r := range renames {
+			name := prometheus.BuildFQName("unbound", "", r.name)
+			names[name] = true
+			metric.outputs = append(metric.outputs, metricOutput{
+				name:      name,
+				desc:      prometheus.NewDesc(name, r.description, md.labels, constLabels),
+				valueType: r.valueType,
+			})
+			metric.counter = metric.counter && r.valueType == prometheus.CounterValue
+		}
+		// Statistics that v2 types as gauges, such as infra.cache.count,
+		// go down on their own, even where v1 exports them as counters.
+		if md.v2 != nil && md.v2.valueType != prometheus.CounterValue {
+			metric.counter = false
+		}
+		metrics = append(metrics, metric)
+	}
+
+	patterns := make([]*regexp.Regexp, len(metrics))
+	for i, metric := range metrics {
+		patterns[i] = metric.pattern
+	}
+
+	return &metricSet{
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "up"),
+			"Whether scraping Unbound's metrics was successful.",
+			nil, constLabels),
+		histogram: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "response_time_seconds"),
+			"Query response time in seconds.",
+			nil, constLabels),
+		lastSuccess: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "last_successful_scrape_timestamp_seconds"),
+			"Time of the last successful scrape of Unbound's statistics, in seconds since 1970.",
+			nil, constLabels),
+		resets: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "counter_resets_detected_total"),
+			"Number of times Unbound's counters were found reset without Unbound restarting, and compensated for.",
+			nil, constLabels),
+		parseErrors: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "parse_errors_total"),
+			"Number of lines of Unbound's replies that could not be parsed, by reason.",
+			[]string{"reason"}, constLabels),
+		serverCert: newCertNotAfterDesc(constLabels),
+		scrapeDuration: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "scrape_duration_seconds"),
+			"Duration of the phases of the last round trip to Unbound, in seconds.",
+			[]string{"phase"}, constLabels),
+		scrapeErrors: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "scrape_errors_total"),
+			"Number of failed round trips to Unbound, by reason, including scrapes that gave up waiting for one.",
+			[]string{"reason"}, constLabels),
+		scrapeFailure: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "last_scrape_failure"),
+			"Always 1, with the phase the last round trip to Unbound failed in and the reason, if it failed.",
+			[]string{"phase", "reason"}, constLabels),
+		replyBytes: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "scrape_bytes_read"),
+			"Size of Unbound's last reply, in bytes.",
+			nil, constLabels),
+		linesParsed: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "scrape_lines_parsed"),
+			"Number of statistics parsed from Unbound's last reply.",
+			nil, constLabels),
+		linesMatched: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "scrape_lines_matched"),
+			"Number of statistics of Unbound's last reply with a metric mapping.",
+			nil, constLabels),
+		foldedValues: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "folded_label_values"),
+			"Number of values of a label folded into \"other\" by the label limits in Unbound's last reply.",
+			[]string{"metric", "label"}, constLabels),
+		metrics:       metrics,
+		matcher:       newKeyMatcher(patterns),
+		responseTime:  true,
+		histogramMode: HistogramClassic,
+		sum:           &sumTracker{},
+		sumCorrections: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "response_time_sum_corrections_total"),
+			"Number of times the sum of unbound_response_time_seconds, reconstructed from Unbound's rounded average, went backwards and was held at its previous value.",
+			nil, constLabels),
+		responseTimeSummary: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "response_time_estimated_seconds"),
+			"Quantiles of the query response time in seconds, estimated from the buckets of unbound_response_time_seconds.",
+			nil, constLabels),
+		unmapped: UnmappedNone,
+		unmappedKeys: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "exporter", "unmapped_keys"),
+			"Number of statistics in Unbound's last reply without a metric mapping.",
+			nil, constLabels),
+		stat: prometheus.NewDesc(
+			prometheus.BuildFQName("unbound", "", "stat"),
+			"Unbound statistic without a metric mapping, by its key in Unbound's reply.",
+			[]string{"key"}, constLabels),
+		constLabels: constLabels,
+		names:       names,
+		log:         slog.New(slog.DiscardHandler),
+	}
+}
+
+// Ways of exporting statistics for which no metric mapping exists.
+const (
+	// UnmappedNone drops them.
+	UnmappedNone = "none"
+	// UnmappedStat exports them as unbound_stat{key="..."}.
+	UnmappedStat = "stat"
+	// UnmappedSanitize exports them under a name derived from their key,
+	// such as unbound_tcpusage{thread="0"} for thread0.tcpusage.
+	UnmappedSanitize = "sanitize"
+)
+
 var (
-	unboundUpDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("unbound", "", "up"),
-		"Whether scraping Unbound's metrics was successful.",
-		nil, nil)
-
-	unboundHistogram = prometheus.NewDesc(
-		prometheus.BuildFQName("unbound", "", "response_time_seconds"),
-		"Query response time in seconds.",
-		nil, nil)
-
-	unboundMetrics = []metricDescription{
-		{
-			"answer_rcodes_total",
-			"Total number of answers to queries, from cache or from recursion, by response code.",
-			prometheus.CounterValue,
-			[]string{"rcode"},
-			"^num\\.answer\\.rcode\\.(\\w+)$",
-		},
-		{
-			"answers_bogus",
-			"Total number of answers that were bogus.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.answer\\.bogus$",
-		},
-		{
-			"answers_secure_total",
-			"Total number of answers that were secure.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.answer\\.secure$",
-		},
-		{
-			"cache_hits_total",
-			"Total number of queries that were successfully answered using a cache lookup.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.cachehits$",
-		},
-		{
-			"cache_misses_total",
-			"Total number of cache queries that needed recursive processing.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.cachemiss$",
-		},
-		{
-			"query_subnet_total",
-			"Total number of queries that got an answer that contained EDNS client subnet data.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.subnet$",
-		},
-		{
-			"query_subnet_cache_total",
-			"Total number of queries answered from the edns client subnet cache.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.subnet_cache$",
-		},
-		{
-			"queries_cookie_client_total",
-			"Total number of queries with a client cookie.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.queries_cookie_client$",
-		},
-		{
-			"queries_cookie_invalid_total",
-			"Total number of queries with a invalid cookie.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.queries_invalid_client$",
-		},
-		{
-			"queries_cookie_valid_total",
-			"Total number of queries with a valid cookie.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.queries_cookie_valid$",
-		},
-		{
-			"memory_caches_bytes",
-			"Memory in bytes in use by caches.",
-			prometheus.GaugeValue,
-			[]string{"cache"},
-			"^mem\\.cache\\.(\\w+)$",
-		},
-		{
-			"memory_modules_bytes",
-			"Memory in bytes in use by modules.",
-			prometheus.GaugeValue,
-			[]string{"module"},
-			"^mem\\.mod\\.(\\w+)$",
-		},
-		{
-			"memory_sbrk_bytes",
-			"Memory in bytes allocated through sbrk.",
-			prometheus.GaugeValue,
-			nil,
-			"^mem\\.total\\.sbrk$",
-		},
-		{
-			"prefetches_total",
-			"Total number of cache prefetches performed.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.prefetch$",
-		},
-		{
-			"queries_total",
-			"Total number of queries received.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.queries$",
-		},
-		{
-			"expired_total",
-			"Total number of expired entries served.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.expired$",
-		},
-		{
-			"query_classes_total",
-			"Total number of queries with a given query class.",
-			prometheus.CounterValue,
-			[]string{"class"},
-			"^num\\.query\\.class\\.([\\w]+)$",
-		},
-		{
-			"query_flags_total",
-			"Total number of queries that had a given flag set in the header.",
-			prometheus.CounterValue,
-			[]string{"flag"},
-			"^num\\.query\\.flags\\.([\\w]+)$",
-		},
-		{
-			"query_ipv6_total",
-			"Total number of queries that were made using IPv6 towards the Unbound server.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.ipv6$",
-		},
-		{
-			"query_opcodes_total",
-			"Total number of queries with a given query opcode.",
-			prometheus.CounterValue,
-			[]string{"opcode"},
-			"^num\\.query\\.opcode\\.([\\w]+)$",
-		},
-		{
-			"query_edns_DO_total",
-			"Total number of queries that had an EDNS OPT record with the DO (DNSSEC OK) bit set present.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.edns\\.DO$",
-		},
-		{
-			"query_edns_present_total",
-			"Total number of queries that had an EDNS OPT record present.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.edns\\.present$",
-		},
-		{
-			"query_tcp_total",
-			"Total number of queries that were made using TCP towards the Unbound server, including DoT and DoH queries.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.tcp$",
-		},
-		{
-			"query_tcpout_total",
-			"Total number of queries that the Unbound server made using TCP outgoing towards other servers.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.tcpout$",
-		},
-		{
-			"query_tls_total",
-			"Total number of queries that were made using TCP TLS towards the Unbound server, including DoT and DoH queries.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.tls$",
-		},
-		{
-			"query_tls_resume_total",
-			"Total number of queries that were made using TCP TLS Resume towards the Unbound server.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.tls\\.resume$",
-		},
-		{
-			"query_https_total",
-			"Total number of DoH queries that were made towards the Unbound server.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.https$",
-		},
-		{
-			"query_types_total",
-			"Total number of queries with a given query type.",
-			prometheus.CounterValue,
-			[]string{"type"},
-			"^num\\.query\\.type\\.([\\w]+)$",
-		},
-		{
-			"query_udpout_total",
-			"Total number of queries that the Unbound server made using UDP outgoing towards￼other servers.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.udpout$",
-		},
-		{
-			"query_aggressive_nsec",
-			"Total number of queries that the Unbound server generated response using Aggressive NSEC.",
-			prometheus.CounterValue,
-			[]string{"rcode"},
-			"^num\\.query\\.aggressive\\.(\\w+)$",
-		},
-		{
-			"request_list_current_all",
-			"Current size of the request list, including internally generated queries.",
-			prometheus.GaugeValue,
-			[]string{"thread"},
-			"^thread([0-9]+)\\.requestlist\\.current\\.all$",
-		},
-		{
-			"request_list_current_replies",
-			"Current count of the number of reply entries waiting on request list entries.",
-			prometheus.GaugeValue,
-			[]string{"thread"},
-			"^thread([0-9]+)\\.requestlist\\.current\\.replies$",
-		},
-		{
-			"request_list_current_user",
-			"Current size of the request list, only counting the requests from client queries.",
-			prometheus.GaugeValue,
-			[]string{"thread"},
-			"^thread([0-9]+)\\.requestlist\\.current\\.user$",
-		},
-		{
-			"request_list_exceeded_total",
-			"Number of queries that were dropped because the request list was full.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread([0-9]+)\\.requestlist\\.exceeded$",
-		},
-		{
-			"request_list_overwritten_total",
-			"Total number of requests in the request list that were overwritten by newer entries.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread([0-9]+)\\.requestlist\\.overwritten$",
-		},
-		{
-			"recursive_replies_total",
-			"Total number of replies sent to queries that needed recursive processing.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.recursivereplies$",
-		},
-		{
-			"rrset_bogus_total",
-			"Total number of rrsets marked bogus by the validator.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.rrset\\.bogus$",
-		},
-		{
-			"rrset_cache_max_collisions_total",
-			"Total number of rrset cache hashtable collisions.",
-			prometheus.CounterValue,
-			nil,
-			"^rrset\\.cache\\.max_collisions$",
-		},
-		{
-			"time_elapsed_seconds",
-			"Time since last statistics printout in seconds.",
-			prometheus.CounterValue,
-			nil,
-			"^time\\.elapsed$",
-		},
-		{
-			"time_now_seconds",
-			"Current time in seconds since 1970.",
-			prometheus.GaugeValue,
-			nil,
-			"^time\\.now$",
-		},
-		{
-			"time_up_seconds_total",
-			"Uptime since server boot in seconds.",
-			prometheus.CounterValue,
-			nil,
-			"^time\\.up$",
-		},
-		{
-			"unwanted_queries_total",
-			"Total number of queries that were refused or dropped because they failed the access control settings.",
-			prometheus.CounterValue,
-			nil,
-			"^unwanted\\.queries$",
-		},
-		{
-			"unwanted_replies_total",
-			"Total number of replies that were unwanted or unsolicited.",
-			prometheus.CounterValue,
-			nil,
-			"^unwanted\\.replies$",
-		},
-		{
-			"recursion_time_seconds_avg",
-			"Average time it took to answer queries that needed recursive processing (does not include in-cache requests).",
-			prometheus.GaugeValue,
-			nil,
-			"^total\\.recursion\\.time\\.avg$",
-		},
-		{
-			"recursion_time_seconds_median",
-			"The median of the time it took to answer queries that needed recursive processing.",
-			prometheus.GaugeValue,
-			nil,
-			"^total\\.recursion\\.time\\.median$",
-		},
-		{
-			"msg_cache_count",
-			"The number of Messages cached",
-			prometheus.GaugeValue,
-			nil,
-			"^msg\\.cache\\.count$",
-		},
-		{
-			"msg_cache_max_collisions_total",
-			"Total number of msg cache hashtable collisions.",
-			prometheus.CounterValue,
-			nil,
-			"^msg\\.cache\\.max_collisions$",
-		},
-		{
-			"rrset_cache_count",
-			"The number of rrset cached",
-			prometheus.GaugeValue,
-			nil,
-			"^rrset\\.cache\\.count$",
-		},
-		{
-			"rpz_action_count",
-			"Total number of triggered Response Policy Zone actions, by type.",
-			prometheus.CounterValue,
-			[]string{"type"},
-			"^num\\.rpz\\.action\\.rpz-([\\w-]+)$",
-		},
-		{
-			"memory_doh_bytes",
-			"Memory used by DoH buffers, in bytes.",
-			prometheus.GaugeValue,
-			[]string{"buffer"},
-			"^mem\\.http\\.(\\w+)$",
-		},
-		{
-			"infra_cache_count",
-			"Total number of infra cache entries",
-			prometheus.CounterValue,
-			nil,
-			"^infra\\.cache\\.count$",
-		},
-		{
-			"memory_doq_bytes",
-			"Memory used by DoQ buffers, in bytes.",
-			prometheus.GaugeValue,
-			nil,
-			"^mem\\.quic$",
-		},
-		{
-			"query_quic_total",
-			"Total number of DNS-over-QUIC (DoQ) queries performed towards the Unbound server.",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.query\\.quic$",
-		},
-		{
-			"dns_error_reports",
-			"Total number of DNS Error Reports generated",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.dns_error_reports$",
-		},
-		{
-			"queries_discard_timeout",
-			"Total number of queries removed due to discard-timeout.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.queries_discard_timeout$",
-		},
-		{
-			"queries_replyaddr_limit",
-			"Total number of queries removed due to replyaddr limits.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.queries_replyaddr_limit$",
-		},
-		{
-			"queries_wait_limit",
-			"Total number of queries removed due to wait-limit.",
-			prometheus.CounterValue,
-			[]string{"thread"},
-			"^thread(\\d+)\\.num\\.queries_wait_limit$",
-		},
-		{
-			"signature_validations",
-			"Total number of signature validation operations performed by the validator module",
-			prometheus.CounterValue,
-			nil,
-			"^num\\.valops$",
-		},
+	threadKeyPattern = regexp.MustCompile(`^thread(\d+)\.(.+)$`)
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+)
+
+// reservedNames and reservedPrefixes cover the names of the metrics exported
+// besides the mapped ones: the exporter's own, those of the control commands
+// and those of the TLS credentials. Unmapped statistics must not take them
+// over.
+var (
+	reservedNames = map[string]bool{
+		"unbound_up":   true,
+		"unbound_stat": true,
+		"unbound_last_successful_scrape_timestamp_seconds": true,
+		"unbound_counter_resets_detected_total":            true,
+		"unbound_build_info":                               true,
+		"unbound_threads":                                  true,
+		"unbound_verbosity":                                true,
+		"unbound_process_id":                               true,
+	}
+	reservedPrefixes = []string{
+		"unbound_exporter_", "unbound_response_time_", "unbound_control_",
+		"unbound_infra_", "unbound_auth_zone_", "unbound_request_list_",
+		"unbound_ratelimit_", "unbound_ip_ratelimit_",
 	}
 )
 
-type unboundMetric struct {
-	desc      *prometheus.Desc
-	valueType prometheus.ValueType
-	pattern   *regexp.Regexp
+func reservedName(name string) bool {
+	if reservedNames[name] {
+		return true
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
-func compileMetrics() []unboundMetric {
-	metrics := make([]unboundMetric, 0, len(unboundMetrics))
-
-	for _, md := range unboundMetrics {
-		metrics = append(metrics, unboundMetric{
-			desc: prometheus.NewDesc(
-				prometheus.BuildFQName("unbound", "", md.name),
-				md.description,
-				md.labels,
-				nil),
-			valueType: md.valueType,
-			pattern:   regexp.MustCompile(md.pattern),
-		})
+// reservedLabels are the names of the labels set per series by the metrics
+// besides the mapped ones, including those Prometheus reserves for
+// histograms and summaries, and the profile label of the TLS credentials.
+var reservedLabels = []string{
+	"thread", "key", "reason", "phase", "metric", "label", "le", "quantile",
+	"version", "modules", "role", "subject", "serial", "profile",
+	"ip", "zone", "kind", "qtype", "state", "qname", "domain",
+}
+
+// LabelNames returns the names of the labels that the exporter's metrics
+// set per series, with the metric mapping of mapping if it is not nil.
+// Constant labels, such as those of configured targets, must not use them,
+// as a metric cannot carry a label twice.
+func LabelNames(mapping *Mapping) map[string]bool {
+	table := unboundMetrics
+	if mapping != nil {
+		table = mapping.metrics
+	}
+	names := make(map[string]bool, len(reservedLabels))
+	for _, name := range reservedLabels {
+		names[name] = true
 	}
+	for _, md := range table {
+		for _, name := range md.labels {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// collectUnmapped exports the statistic s, which no metric mapping matched.
+func (m *metricSet) collectUnmapped(s stat, ch chan<- prometheus.Metric) {
+	switch m.unmapped {
+	case UnmappedStat:
+		ch <- prometheus.MustNewConstMetric(m.stat, prometheus.UntypedValue, s.value, s.key)
+	case UnmappedSanitize:
+		key, labelNames, labelValues := s.key, []string(nil), []string(nil)
+		help := "Unbound statistic " + s.key + " without a metric mapping."
+		if matches := threadKeyPattern.FindStringSubmatch(s.key); matches != nil {
+			key, labelNames, labelValues = matches[2], []string{"thread"}, matches[1:2]
+			help = "Unbound statistic threadN." + key + " without a metric mapping."
+		}
+		name := "unbound_" + invalidNameChars.ReplaceAllString(key, "_")
+		if m.names[name] || reservedName(name) {
+			m.conflict(s.key, name, "metric exported by the exporter")
+			return
+		}
+		// A name can only be exported with one set of labels, which the
+		// first statistic to take it decides, as with threadN.tcpusage
+		// and a plain tcpusage.
+		cacheKey := name + "{" + strings.Join(labelNames, ",") + "}"
+		if first, _ := m.sanitizedNames.LoadOrStore(name, cacheKey); first != cacheKey {
+			m.conflict(s.key, name, "statistic with other labels")
+			return
+		}
+
+		desc, ok := m.sanitized.Load(cacheKey)
+		if !ok {
+			desc, _ = m.sanitized.LoadOrStore(cacheKey, prometheus.NewDesc(name, help, labelNames, m.constLabels))
+		}
+		ch <- prometheus.MustNewConstMetric(desc.(*prometheus.Desc), prometheus.UntypedValue, s.value, labelValues...)
+	}
+}
 
-	return metrics
+// conflict logs, once per key, that the unmapped statistic key is skipped
+// because its sanitized name is taken.
+func (m *metricSet) conflict(key, name, by string) {
+	if _, logged := m.conflicts.LoadOrStore(key, true); !logged {
+		m.log.Warn("Skipped unmapped statistic whose sanitized name is taken", "key", key, "name", name, "by", by)
+	}
 }
 
-func collectFromReader(metrics []unboundMetric, file io.Reader, ch chan<- prometheus.Metric) error {
+// isCounter returns true if key is exported as a counter or a histogram
+// bucket.
+func (m *metricSet) isCounter(key string) bool {
+	if i, _, ok := m.matcher.match(key); ok {
+		return m.metrics[i].counter
+	}
+	return strings.HasPrefix(key, "histogram.") && histogramPattern.MatchString(key)
+}
+
+// stat is a single key=value line of Unbound's statistics.
+type stat struct {
+	key   string
+	value float64
+}
+
+// readStats parses the statistics printed by Unbound's stats_noreset
+// command. In strict mode, the first line that cannot be parsed fails the
+// whole reply; in lenient mode, such lines are skipped. Either way, the
+// rejected lines are returned. An error message from Unbound always fails
+// the reply.
+func readStats(file io.Reader, lenient bool) ([]stat, []*lineError, error) {
 	scanner := bufio.NewScanner(file)
 	scanner.Split(bufio.ScanLines)
-	histogramPattern := regexp.MustCompile(`^histogram\.\d+\.\d+\.to\.(\d+\.\d+)$`)
-
-	histogramCount := uint64(0)
-	histogramAvg := float64(0)
-	histogramBuckets := make(map[float64]uint64)
 
+	var stats []stat
+	var rejected []*lineError
 	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), "=")
+		line := scanner.Text()
+		if strings.HasPrefix(line, "error ") {
+			return nil, rejected, &scrapeError{reasonUnbound, errors.New(line)}
+		}
+
+		var lineErr *lineError
+		fields := strings.Split(line, "=")
 		if len(fields) != 2 {
-			return fmt.Errorf(
-				"%q is not a valid key-value pair",
-				scanner.Text())
+			lineErr = &lineError{lineMalformed, line, errors.New("not a valid key-value pair")}
+		} else if value, err := strconv.ParseFloat(fields[1], 64); err != nil {
+			lineErr = &lineError{lineInvalidValue, line, err}
+		} else {
+			stats = append(stats, stat{fields[0], value})
+			continue
 		}
 
-		for _, metric := range metrics {
-			if matches := metric.pattern.FindStringSubmatch(fields[0]); matches != nil {
-				value, err := strconv.ParseFloat(fields[1], 64)
-				if err != nil {
-					return err
-				}
-				ch <- prometheus.MustNewConstMetric(
-					metric.desc,
-					metric.valueType,
-					value,
-					matches[1:]...)
+		rejected = append(rejected, lineErr)
+		if !lenient {
+			return nil, rejected, &scrapeError{reasonParse, lineErr}
+		}
+	}
 
-				break
+	if err := scanner.Err(); err != nil {
+		return nil, rejected, &scrapeError{reasonRead, err}
+	}
+	return stats, rejected, nil
+}
+
+var histogramPattern = regexp.MustCompile(`^histogram\.\d+\.\d+\.to\.(\d+\.\d+)$`)
+
+// collectStats converts Unbound's statistics to the metrics of the selected
+// families. It returns the keys of the statistics for which no metric
+// mapping exists.
+func collectStats(metrics *metricSet, stats []stat, families Families, ch chan<- prometheus.Metric) []string {
+	latency := metrics.responseTime && families.selects(latencyFamily)
+	histogramCount := uint64(0)
+	histogramAvg := float64(0)
+	histogramBuckets := make(map[float64]uint64)
+	var unmapped []stat
+	// pending holds the samples of guarded metrics, by metric index.
+	pending := map[int][]sample{}
+	// seen holds the label values of the metrics to zero-fill, by metric
+	// index.
+	seen := map[int]map[string]bool{}
+	// aggregated holds the keys, without their threadN. or total. prefix,
+	// of mapped statistics that Unbound reports both per thread and summed
+	// over threads. Whichever of the two is not mapped is left out on
+	// purpose, depending on the thread mode.
+	aggregated := map[string]bool{}
+
+	for _, s := range stats {
+		i, labels, mapped := metrics.matcher.match(s.key)
+		if mapped && metrics.metrics[i].enabled() && families.selects(metrics.metrics[i].family) {
+			metric := metrics.metrics[i]
+			value := s.value
+			if metric.scale != 0 {
+				value *= metric.scale
+			}
+			if metric.translate {
+				translateLabels(metric.labels, labels)
+			}
+			if len(metric.zeroFill) > 0 {
+				if seen[i] == nil {
+					seen[i] = map[string]bool{}
+				}
+				seen[i][labels[0]] = true
+			}
+			if metric.guarded {
+				pending[i] = append(pending[i], sample{labels, value})
+			} else {
+				metric.send(ch, value, labels...)
 			}
 		}
+		if suffix, ok := aggregateSuffix(s.key); mapped && ok {
+			aggregated[suffix] = true
+		}
 
-		if matches := histogramPattern.FindStringSubmatch(fields[0]); matches != nil {
+		// The prefix spares other keys the regular expression.
+		var matches []string
+		if strings.HasPrefix(s.key, "histogram.") {
+			matches = histogramPattern.FindStringSubmatch(s.key)
+		}
+		if matches != nil {
 			end, err := strconv.ParseFloat(matches[1], 64)
 			if err != nil {
-				return err
+				continue // Unreachable: the pattern only matches decimal numbers
 			}
-			value, err := strconv.ParseUint(fields[1], 10, 64)
-			if err != nil {
-				return err
-			}
-			histogramBuckets[end] = value
-			histogramCount += value
-		} else if fields[0] == "total.recursion.time.avg" {
-			value, err := strconv.ParseFloat(fields[1], 64)
-			if err != nil {
-				return err
+			histogramBuckets[end] = uint64(s.value)
+			histogramCount += uint64(s.value)
+			mapped = true
+		} else if s.key == "total.recursion.time.avg" {
+			histogramAvg = s.value
+			mapped = true
+		}
+
+		if !mapped {
+			unmapped = append(unmapped, s)
+		}
+	}
+
+	// Values Unbound omits until it counts them are filled in with zeros,
+	// so that their series do not come and go.
+	zeros := map[int][]string{}
+	for i, metric := range metrics.metrics {
+		if len(metric.zeroFill) == 0 || !metric.enabled() || !families.selects(metric.family) {
+			continue
+		}
+		for _, value := range metric.zeroFill {
+			switch {
+			case seen[i][value]:
+			case metric.guarded:
+				zeros[i] = append(zeros[i], value)
+			default:
+				metric.send(ch, 0, value)
 			}
-			histogramAvg = value
 		}
 	}
+	metrics.collectGuarded(pending, zeros, ch)
+
+	var unmappedKeys []string
+	for _, s := range unmapped {
+		if suffix, ok := aggregateSuffix(s.key); ok && aggregated[suffix] {
+			continue
+		}
+		unmappedKeys = append(unmappedKeys, s.key)
+		metrics.collectUnmapped(s, ch)
+	}
 
-	// Convert the metrics to a cumulative Prometheus histogram.
 	// Reconstruct the sum of all samples from the average value
-	// provided by Unbound. Hopefully this does not break
-	// monotonicity.
-	keys := []float64{}
-	for k := range histogramBuckets {
-		keys = append(keys, k)
-	}
-	sort.Float64s(keys)
-	prev := uint64(0)
-	for _, i := range keys {
-		histogramBuckets[i] += prev
-		prev = histogramBuckets[i]
-	}
-	ch <- prometheus.MustNewConstHistogram(
-		unboundHistogram,
-		histogramCount,
-		histogramAvg*float64(histogramCount),
-		histogramBuckets)
-
-	return scanner.Err()
-}
+	// provided by Unbound, which collectResponseTime keeps from
+	// going backwards.
+	if latency {
+		metrics.collectResponseTime(
+			histogramCount,
+			histogramAvg*float64(histogramCount),
+			histogramBuckets,
+			ch)
+	}
 
-func (e *UnboundExporter) collectFromSocket(socketFamily string, host string, tlsConfig *tls.Config, ch chan<- prometheus.Metric) error {
-	var (
-		conn net.Conn
-		err  error
-	)
+	return unmappedKeys
+}
 
-	if socketFamily == "unix" || tlsConfig == nil {
-		conn, err = net.Dial(socketFamily, host)
-	} else {
-		conn, err = tls.Dial(socketFamily, host, tlsConfig)
+// aggregateSuffix returns key without its threadN. or total. prefix.
+func aggregateSuffix(key string) (string, bool) {
+	if !strings.HasPrefix(key, "thread") && !strings.HasPrefix(key, "total.") {
+		return "", false
 	}
+	_, suffix, ok := strings.Cut(key, ".")
+	return suffix, ok
+}
+
+func collectFromReader(metrics *metricSet, file io.Reader, ch chan<- prometheus.Metric) error {
+	stats, _, err := readStats(file, false)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	_, err = conn.Write([]byte("UBCT1 stats_noreset\n"))
-	if err != nil {
-		return err
-	}
-	return collectFromReader(e.metrics, conn, ch)
+	collectStats(metrics, stats, nil, ch)
+	return nil
 }
 
 type UnboundExporter struct {
@@ -576,103 +577,454 @@ type UnboundExporter struct {
 
 	socketFamily string
 	host         string
+	shmKey       int
 	tlsConfig    *tls.Config
+	timeout      time.Duration
+	pollInterval time.Duration
+	lenient      bool
+	// commands are the control commands run after the statistics.
+	commands []controlCommand
+
+	metrics *metricSet
 
-	metrics []unboundMetric
+	// accumulator compensates for counter resets, if enabled.
+	accumulator *accumulator
 
 	// unboundUp is true if the last scrape was healthy. Used for /_healthz
 	// False initially, so this will return unhealthy until the first metric scrape has succeeded.
 	unboundUp atomic.Bool
+
+	// mu protects the fields below, which track round trips to Unbound.
+	mu sync.Mutex
+	// inflight is the round trip in progress, if any.
+	inflight *flight
+	// polled is the outcome of the last poll, in polling mode.
+	polled *snapshot
+	// succeeded is the time of the last successful round trip.
+	succeeded time.Time
+	// serverCert is the certificate Unbound presented on the last TLS
+	// connection.
+	serverCert *x509.Certificate
+	// parseErrors counts the lines of Unbound's replies rejected by the
+	// parser, by reason.
+	parseErrors map[string]float64
+	// scrapeErrors counts the failed round trips, by reason.
+	scrapeErrors map[string]float64
+	// commandFailed holds the control commands whose failure was logged.
+	commandFailed map[string]bool
+}
+
+// Options holds the settings of an UnboundExporter beyond its control socket
+// address.
+type Options struct {
+	// TLSConfig is used to connect to TCP control sockets. If nil, TCP
+	// connections are made in plaintext. It is ignored for Unix sockets.
+	TLSConfig *tls.Config
+
+	// ConstLabels are attached to every metric of this exporter, so that
+	// several exporters can be registered with the same registry.
+	ConstLabels prometheus.Labels
+
+	// Timeout bounds each round trip to Unbound, including connecting to
+	// it. Scrapes made through CollectContext additionally stop waiting
+	// for the round trip at the deadline of their context, without cutting
+	// it short for concurrent scrapes sharing it. Zero means a round trip
+	// may take up to a minute.
+	Timeout time.Duration
+
+	// PollInterval enables polling mode if not zero. In polling mode,
+	// Unbound is scraped every PollInterval by Poll, which the caller must
+	// start, and metrics are served from the outcome of the last poll.
+	PollInterval time.Duration
+
+	// AccumulateCounters enables compensation for counter resets caused by
+	// `unbound-control stats`: counters are exported as running totals
+	// that keep increasing across such resets.
+	AccumulateCounters bool
+
+	// CounterStore persists the running totals of counters across restarts
+	// of the exporter, if AccumulateCounters is set. May be nil.
+	CounterStore *CounterStore
+
+	// LenientParsing skips lines of Unbound's reply that cannot be parsed,
+	// instead of failing the whole scrape. Skipped lines are counted by
+	// unbound_exporter_parse_errors_total.
+	LenientParsing bool
+
+	// Status enables the status command, run after the statistics on
+	// control sockets, for unbound_build_info, unbound_threads,
+	// unbound_verbosity and unbound_process_id.
+	Status bool
+
+	// Infra enables the dump_infra command, run like Status, for the
+	// unbound_infra_* metrics, if not nil.
+	Infra *InfraOptions
+
+	// RequestList enables the dump_requestlist command, run like Status,
+	// for the unbound_request_list_* metrics, if not nil.
+	RequestList *RequestListOptions
+
+	// RateLimit enables the ratelimit_list and ip_ratelimit_list commands,
+	// run like Status, for the unbound_ratelimit_* and
+	// unbound_ip_ratelimit_* metrics. The label limits of domain and ip
+	// bound the offenders exported.
+	RateLimit bool
+
+	// AuthZones enables the list_auth_zones command, run like Status, for
+	// the unbound_auth_zone_* metrics.
+	AuthZones bool
+
+	// Mapping replaces the built-in table of metric mappings, if not nil.
+	Mapping *Mapping
+
+	// Histogram selects how unbound_response_time_seconds is exported:
+	// HistogramClassic, HistogramNative or HistogramBoth. Empty means
+	// HistogramClassic.
+	Histogram string
+
+	// ResponseTimeQuantiles are the quantiles of the response time to
+	// estimate from the histogram and export as a summary, if any.
+	ResponseTimeQuantiles []float64
+
+	// LabelLimits bound the values of labels driven by client traffic, by
+	// label name, such as type for unbound_query_types_total. A limit
+	// applies to every metric with the label unless it names its Metrics.
+	LabelLimits map[string]LabelLimit
+
+	// ZeroFill exports the values of labels that the mapping lists as
+	// zero_fill as zero when Unbound omits them.
+	ZeroFill bool
+
+	// Naming selects the names and types of the metrics. The default is
+	// NamingV1.
+	Naming string
+
+	// ThreadMode selects how per-thread statistics are exported. The default
+	// is ThreadModePerThread.
+	ThreadMode string
+
+	// NameFilter leaves out metrics of Unbound's statistics by name.
+	NameFilter NameFilter
+
+	// Unmapped selects how statistics without a metric mapping are
+	// exported: UnmappedNone, UnmappedStat or UnmappedSanitize. Empty
+	// means UnmappedNone.
+	Unmapped string
 }
 
-func tlsConfig(ca string, cert string, key string) (*tls.Config, error) {
-	// Server authentication
-	caData, err := os.ReadFile(ca)
+func NewUnboundExporter(host string, opts Options, log *slog.Logger) (*UnboundExporter, error) {
+	u, err := url.Parse(host)
 	if err != nil {
 		return nil, err
 	}
-	roots := x509.NewCertPool()
-	if !roots.AppendCertsFromPEM(caData) {
-		return nil, errors.New("failed to parse CA")
+
+	labelNames := LabelNames(opts.Mapping)
+	for name := range opts.ConstLabels {
+		if labelNames[name] {
+			return nil, fmt.Errorf("constant label %q is also the name of a variable label", name)
+		}
 	}
 
-	// Client authentication
-	certData, err := os.ReadFile(cert)
-	if err != nil {
-		return nil, err
+	table := unboundMetrics
+	if opts.Mapping != nil {
+		table = opts.Mapping.metrics
+	}
+	switch opts.Naming {
+	case "", NamingV1, NamingV2, NamingBoth:
+		table = namingTable(table, opts.Naming)
+	default:
+		return nil, fmt.Errorf("unknown naming scheme %q", opts.Naming)
+	}
+	switch opts.ThreadMode {
+	case "", ThreadModePerThread, ThreadModeTotal, ThreadModeBoth:
+		table = threadTable(table, opts.ThreadMode)
+	default:
+		return nil, fmt.Errorf("unknown thread mode %q", opts.ThreadMode)
 	}
 
-	keyData, err := os.ReadFile(key)
-	if err != nil {
-		return nil, err
+	newExporter := UnboundExporter{
+		log:           log,
+		socketFamily:  u.Scheme,
+		timeout:       opts.Timeout,
+		pollInterval:  opts.PollInterval,
+		lenient:       opts.LenientParsing,
+		metrics:       compileMetrics(table, opts.ConstLabels),
+		parseErrors:   make(map[string]float64, len(lineErrorReasons)),
+		scrapeErrors:  make(map[string]float64, len(scrapeErrorReasons)),
+		commandFailed: map[string]bool{},
 	}
 
-	keyPair, err := tls.X509KeyPair(certData, keyData)
-	if err != nil {
-		return nil, err
+	switch u.Scheme {
+	case "unix":
+		newExporter.host = u.Path
+	case "shm":
+		newExporter.host = u.Host
+		key, err := strconv.ParseInt(u.Host, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shared memory key in %q: %w", host, err)
+		}
+		newExporter.shmKey = int(key)
+	default:
+		newExporter.host = u.Host
+		newExporter.tlsConfig = opts.TLSConfig
+	}
+	if newExporter.host == "" {
+		return nil, fmt.Errorf("no control socket address in %q", host)
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{keyPair},
-		RootCAs:      roots,
-		ServerName:   "unbound",
-	}, nil
-}
+	newExporter.metrics.log = log
+	switch opts.Unmapped {
+	case "":
+	case UnmappedNone, UnmappedStat, UnmappedSanitize:
+		newExporter.metrics.unmapped = opts.Unmapped
+	default:
+		return nil, fmt.Errorf("unknown export mode for unmapped statistics %q", opts.Unmapped)
+	}
 
-func NewUnboundExporter(host string, ca string, cert string, key string, log *slog.Logger) (*UnboundExporter, error) {
-	u, err := url.Parse(host)
-	if err != nil {
-		return nil, err
+	switch opts.Histogram {
+	case "":
+	case HistogramClassic, HistogramNative, HistogramBoth:
+		newExporter.metrics.histogramMode = opts.Histogram
+	default:
+		return nil, fmt.Errorf("unknown histogram mode %q", opts.Histogram)
 	}
 
-	newExporter := UnboundExporter{
-		log:          log,
-		socketFamily: u.Scheme,
-		metrics:      compileMetrics(),
+	for label, limit := range opts.LabelLimits {
+		if limit.Max < 0 {
+			return nil, fmt.Errorf("negative limit for label %q", label)
+		}
+		for _, name := range limit.Metrics {
+			if !newExporter.metrics.names[name] && !reservedName(name) {
+				return nil, fmt.Errorf("limit for label %q: unknown metric %q", label, name)
+			}
+		}
+		if newExporter.metrics.guards == nil {
+			newExporter.metrics.guards = make(map[string]*labelGuard, len(opts.LabelLimits))
+		}
+		newExporter.metrics.guards[label] = newLabelGuard(limit)
 	}
+	for i := range newExporter.metrics.metrics {
+		metric := &newExporter.metrics.metrics[i]
+		metric.outputs = slices.DeleteFunc(metric.outputs, func(o metricOutput) bool {
+			return !opts.NameFilter.selects(o.name)
+		})
+		if opts.ZeroFill {
+			metric.zeroFill = table[i].zeroFill
+		}
+		for _, label := range metric.labels {
+			if newExporter.metrics.guard(*metric, label) != nil {
+				metric.guarded = true
+			}
+		}
+		metric.translate = metric.guarded || len(metric.zeroFill) > 0
+	}
+	newExporter.metrics.responseTime = opts.NameFilter.selects("unbound_response_time_seconds")
 
-	if u.Scheme == "unix" {
-		newExporter.host = u.Path
-		return &newExporter, nil
+	for _, q := range opts.ResponseTimeQuantiles {
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %v", q)
+		}
 	}
-	newExporter.host = u.Host
+	newExporter.metrics.quantiles = opts.ResponseTimeQuantiles
 
-	if ca == "" && cert == "" && key == "" {
-		return &newExporter, nil
+	if opts.Status {
+		newExporter.commands = append(newExporter.commands, newStatusCommand(opts.ConstLabels))
+	}
+	if opts.Infra != nil {
+		if opts.Infra.TopN < 0 {
+			return nil, fmt.Errorf("negative number of infra cache entries %d", opts.Infra.TopN)
+		}
+		newExporter.commands = append(newExporter.commands, newInfraCommand(*opts.Infra, opts.ConstLabels))
+	}
+	if opts.RequestList != nil {
+		if opts.RequestList.TopN < 0 {
+			return nil, fmt.Errorf("negative number of request list names %d", opts.RequestList.TopN)
+		}
+		newExporter.commands = append(newExporter.commands, newRequestListCommand(*opts.RequestList, opts.ConstLabels))
+	}
+	if opts.RateLimit {
+		newExporter.commands = append(newExporter.commands,
+			newRateLimitCommand(true, opts.LabelLimits, opts.ConstLabels),
+			newRateLimitCommand(false, opts.LabelLimits, opts.ConstLabels))
+	}
+	if opts.AuthZones {
+		newExporter.commands = append(newExporter.commands, newAuthZonesCommand(opts.ConstLabels))
 	}
 
-	cfg, err := tlsConfig(ca, cert, key)
-	if err != nil {
-		return nil, err
+	if opts.AccumulateCounters {
+		newExporter.accumulator = newAccumulator(host, opts.CounterStore)
 	}
-	newExporter.tlsConfig = cfg
 
 	return &newExporter, nil
 }
 
 func (e *UnboundExporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- unboundUpDesc
-	for _, metric := range e.metrics {
-		ch <- metric.desc
+	ch <- e.metrics.up
+	if e.metrics.responseTime {
+		ch <- e.metrics.histogram
+		ch <- e.metrics.sumCorrections
+		if len(e.metrics.quantiles) > 0 {
+			ch <- e.metrics.responseTimeSummary
+		}
+	}
+	ch <- e.metrics.lastSuccess
+	ch <- e.metrics.parseErrors
+	ch <- e.metrics.unmappedKeys
+	ch <- e.metrics.scrapeDuration
+	ch <- e.metrics.scrapeErrors
+	ch <- e.metrics.scrapeFailure
+	ch <- e.metrics.replyBytes
+	ch <- e.metrics.linesParsed
+	ch <- e.metrics.linesMatched
+	if len(e.metrics.guards) > 0 {
+		ch <- e.metrics.foldedValues
+	}
+	if e.metrics.unmapped == UnmappedStat {
+		ch <- e.metrics.stat
+	}
+	if e.accumulator != nil {
+		ch <- e.metrics.resets
+	}
+	if e.tlsConfig != nil {
+		ch <- e.metrics.serverCert
+	}
+	for _, cmd := range e.commands {
+		cmd.describe(ch)
+	}
+	for _, metric := range e.metrics.metrics {
+		for _, o := range metric.outputs {
+			ch <- o.desc
+		}
 	}
 }
 
 func (e *UnboundExporter) Collect(ch chan<- prometheus.Metric) {
-	err := e.collectFromSocket(e.socketFamily, e.host, e.tlsConfig, ch)
-	if err == nil {
-		e.unboundUp.Store(true)
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext is like Collect, but stops waiting for Unbound once ctx is
+// done, for instance when the HTTP request that triggered it is canceled or
+// exceeds Prometheus' scrape timeout. The round trip itself is bounded by
+// the exporter's timeout, as concurrent scrapes may share it.
+func (e *UnboundExporter) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.CollectFamilies(ctx, nil, ch)
+}
+
+// CollectFamilies is like CollectContext, but only collects the metrics of
+// Unbound's statistics that belong to the given families. Metrics about the
+// exporter itself are always collected.
+func (e *UnboundExporter) CollectFamilies(ctx context.Context, families Families, ch chan<- prometheus.Metric) {
+	var snap snapshot
+	if e.pollInterval > 0 {
+		snap = e.latest()
+	} else {
+		if e.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, e.timeout)
+			defer cancel()
+		}
+		snap = e.scrape(ctx)
+	}
+
+	if snap.err == nil {
+		unmapped := collectStats(e.metrics, snap.stats, families, ch)
+		if len(unmapped) > 0 {
+			e.log.Debug("Unbound statistics without a metric mapping", "keys", unmapped)
+		}
 		ch <- prometheus.MustNewConstMetric(
-			unboundUpDesc,
+			e.metrics.unmappedKeys,
+			prometheus.GaugeValue,
+			float64(len(unmapped)))
+		if e.socketFamily != "shm" {
+			ch <- prometheus.MustNewConstMetric(
+				e.metrics.replyBytes,
+				prometheus.GaugeValue,
+				float64(snap.trace.bytes))
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.linesParsed,
+			prometheus.GaugeValue,
+			float64(snap.trace.lines))
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.linesMatched,
+			prometheus.GaugeValue,
+			float64(len(snap.stats)-len(unmapped)))
+		for _, reply := range snap.replies {
+			reply.collect(ch)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.up,
 			prometheus.GaugeValue,
 			1.0)
 	} else {
-		e.log.Error("Failed to scrape socket", "err", err.Error())
-		e.unboundUp.Store(false)
 		ch <- prometheus.MustNewConstMetric(
-			unboundUpDesc,
+			e.metrics.up,
 			prometheus.GaugeValue,
 			0.0)
 	}
+
+	for i, phase := range snap.trace.phases {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.scrapeDuration,
+			prometheus.GaugeValue,
+			snap.trace.durations[i].Seconds(),
+			phase)
+	}
+	if snap.trace.failed != "" {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.scrapeFailure,
+			prometheus.GaugeValue,
+			1,
+			snap.trace.failed, snap.trace.reason)
+	}
+
+	e.mu.Lock()
+	serverCert := e.serverCert
+	parseErrors := make([]float64, len(lineErrorReasons))
+	for i, reason := range lineErrorReasons {
+		parseErrors[i] = e.parseErrors[reason]
+	}
+	scrapeErrors := make(map[string]float64, len(e.scrapeErrors))
+	for _, reason := range scrapeErrorReasons {
+		scrapeErrors[reason] = 0
+	}
+	for reason, count := range e.scrapeErrors {
+		scrapeErrors[reason] = count
+	}
+	e.mu.Unlock()
+
+	for reason, count := range scrapeErrors {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.scrapeErrors,
+			prometheus.CounterValue,
+			count,
+			reason)
+	}
+
+	for i, reason := range lineErrorReasons {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.parseErrors,
+			prometheus.CounterValue,
+			parseErrors[i],
+			reason)
+	}
+	if serverCert != nil {
+		ch <- certNotAfter(e.metrics.serverCert, "server", serverCert)
+	}
+
+	if lastSuccess := e.lastSuccess(); !lastSuccess.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.lastSuccess,
+			prometheus.GaugeValue,
+			float64(lastSuccess.UnixNano())/1e9)
+	}
+
+	if e.accumulator != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.resets,
+			prometheus.CounterValue,
+			e.accumulator.resets())
+	}
 }
 
 // UnboundUp returns true if we have successfully scraped metrics and Unbound is up.
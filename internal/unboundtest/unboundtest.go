@@ -0,0 +1,78 @@
+// Package unboundtest fakes Unbound's control socket, for the tests of the
+// exporter and metrics packages.
+package unboundtest
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Listen listens on a Unix socket and handles each connection with serve.
+// It returns a unix:// target for the socket.
+func Listen(t testing.TB, serve func(conn net.Conn)) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "unbound.ctl")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return "unix://" + path
+}
+
+// Testdata reads the named file of the exporter's testdata directory, such
+// as metrics.txt, the statistics of an Unbound with three threads.
+func Testdata(t testing.TB, name string) []byte {
+	t.Helper()
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("cannot locate the testdata directory")
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(file), "..", "..", "exporter", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Serve answers the control commands for which reply returns true, and
+// other commands, such as stats_noreset, with the statistics of
+// metrics.txt.
+func Serve(t testing.TB, reply func(command string) (string, bool)) func(conn net.Conn) {
+	stats := Testdata(t, "metrics.txt")
+	return func(conn net.Conn) {
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		command := strings.TrimSuffix(strings.TrimPrefix(string(buf[:n]), "UBCT1 "), "\n")
+		if r, ok := reply(command); ok {
+			_, _ = conn.Write([]byte(r))
+			return
+		}
+		_, _ = conn.Write(stats)
+	}
+}
+
+// Commands is like Serve, with fixed replies by command.
+func Commands(t testing.TB, replies map[string]string) func(conn net.Conn) {
+	return Serve(t, func(command string) (string, bool) {
+		r, ok := replies[command]
+		return r, ok
+	})
+}
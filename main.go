@@ -14,38 +14,256 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/promslog"
 
+	"github.com/letsencrypt/unbound_exporter/config"
 	"github.com/letsencrypt/unbound_exporter/exporter"
 	"github.com/letsencrypt/unbound_exporter/metrics"
 )
 
+// reloadOnSIGHUP reloads the TLS credentials whenever the process receives
+// SIGHUP. They are also reloaded automatically when their files change.
+func reloadOnSIGHUP(creds []*exporter.TLSCredentials, log *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Info("Reloading TLS credentials")
+		for _, c := range creds {
+			err := c.Reload()
+			if err != nil {
+				log.Error("Reloading TLS credentials failed", "err", err.Error())
+			}
+		}
+	}
+}
+
 func main() {
 	log := promslog.New(&promslog.Config{})
 
 	var (
-		listenAddress = flag.String("web.listen-address", ":9167", "Address to listen on for web interface and telemetry.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		healthPath    = flag.String("web.health-path", "/_healthz", "Path under which to expose healthcheck.")
-		unboundHost   = flag.String("unbound.host", "tcp://localhost:8953", "Unix or TCP address of Unbound control socket.")
-		unboundCa     = flag.String("unbound.ca", "/etc/unbound/unbound_server.pem", "Unbound server certificate.")
-		unboundCert   = flag.String("unbound.cert", "/etc/unbound/unbound_control.pem", "Unbound client certificate.")
-		unboundKey    = flag.String("unbound.key", "/etc/unbound/unbound_control.key", "Unbound client key.")
+		listenAddress  = flag.String("web.listen-address", ":9167", "Address to listen on for web interface and telemetry.")
+		metricsPath    = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		healthPath     = flag.String("web.health-path", "/_healthz", "Path under which to expose healthcheck.")
+		unboundHost    = flag.String("unbound.host", "tcp://localhost:8953", "Unix or TCP address of Unbound control socket, or shm://<key> to read Unbound's shared memory statistics.")
+		unboundCa      = flag.String("unbound.ca", "/etc/unbound/unbound_server.pem", "Unbound server certificate.")
+		unboundCert    = flag.String("unbound.cert", "/etc/unbound/unbound_control.pem", "Unbound client certificate.")
+		unboundKey     = flag.String("unbound.key", "/etc/unbound/unbound_control.key", "Unbound client key.")
+		probePath      = flag.String("web.probe-path", "/probe", "Path under which to expose multi-target probes. Empty to disable.")
+		unboundTimeout = flag.Duration("unbound.timeout", 10*time.Second, "Maximum duration of a round trip to Unbound, which concurrent scrapes share, and of the wait of each scrape for it. Scrapes also stop waiting at the scrape timeout sent by Prometheus. Zero means a round trip may take up to a minute.")
+		pollInterval   = flag.Duration("unbound.poll-interval", 0, "If not zero, poll Unbound at this interval in the background and serve scrapes from the last poll.")
+		accumulate     = flag.Bool("unbound.accumulate-counters", false, "Compensate for counter resets caused by `unbound-control stats` by exporting running totals.")
+		counterState   = flag.String("unbound.counter-state-file", "", "Optional file in which to persist the running totals of -unbound.accumulate-counters across restarts.")
+		lenient        = flag.Bool("unbound.lenient-parsing", false, "Skip lines of Unbound's reply that cannot be parsed, instead of failing the scrape.")
+		status         = flag.Bool("unbound.status", false, "Also run Unbound's status command on each scrape, for unbound_build_info, unbound_threads, unbound_verbosity and unbound_process_id.")
+		infra          = flag.Bool("unbound.infra", false, "Also run Unbound's dump_infra command on each scrape, for the unbound_infra_* metrics of upstream nameservers.")
+		infraTopN      = flag.Int("unbound.infra-top-n", 20, "Number of upstream nameservers with the highest round trip time exported with -unbound.infra, besides those of -unbound.infra-zones.")
+		infraZones     = flag.String("unbound.infra-zones", "", "Comma-separated zones whose upstream nameservers are always exported with -unbound.infra.")
+		requestList    = flag.Bool("unbound.request-list", false, "Also run Unbound's dump_requestlist command on each scrape, for the unbound_request_list_* metrics of outstanding queries.")
+		requestTopN    = flag.Int("unbound.request-list-top-n", 10, "Number of query names waited for the longest exported with -unbound.request-list.")
+		rateLimit      = flag.Bool("unbound.ratelimit", false, "Also run Unbound's ratelimit_list and ip_ratelimit_list commands on each scrape, for the domains and client addresses over their rate limit.")
+		authZones      = flag.Bool("unbound.auth-zones", false, "Also run Unbound's list_auth_zones command on each scrape, for the unbound_auth_zone_* metrics.")
+		unmapped       = flag.String("metrics.unmapped", exporter.UnmappedNone, "How to export Unbound statistics without a metric mapping: none, stat (as unbound_stat{key=\"...\"}) or sanitize (under a name derived from the key).")
+		histogram      = flag.String("metrics.histogram", exporter.HistogramClassic, "How to export unbound_response_time_seconds: classic, native or both.")
+		quantiles      = flag.String("metrics.response-time-quantiles", "", "Comma-separated quantiles of the response time, such as 0.5,0.99, to estimate from the histogram and export as unbound_response_time_estimated_seconds.")
+		threadMode     = flag.String("metrics.thread-mode", exporter.ThreadModePerThread, "How to export statistics Unbound reports per thread: per-thread (with a thread label), total (summed over threads, without the label) or both (the sums under names prefixed with total_).")
+		naming         = flag.String("metrics.naming", exporter.NamingV1, "Names and types of the metrics: v1, v2 (following the Prometheus conventions) or both (exporting renamed metrics under both names, for a migration period).")
+		zeroFill       = flag.Bool("metrics.zero-fill", false, "Export known values of labels, such as the SERVFAIL response code, as zero when Unbound omits them.")
+		include        = flag.String("metrics.include", "", "Optional regular expression selecting the metrics of Unbound's statistics to export, matched against whole metric names.")
+		exclude        = flag.String("metrics.exclude", "", "Optional regular expression selecting metrics of Unbound's statistics not to export, matched against whole metric names.")
+		mappingFile    = flag.String("metrics.mapping-file", "", "Optional file in YAML or JSON adding, replacing or dropping entries of the built-in mapping of Unbound's statistics to metrics.")
+		timeoutOffset  = flag.Duration("web.timeout-offset", 500*time.Millisecond, "Offset to subtract from the scrape timeout sent by Prometheus.")
+		configFile     = flag.String("config.file", "", "Optional configuration file defining TLS profiles and targets.")
 	)
 	flag.Parse()
 
 	log.Info("Starting unbound_exporter")
-	exp, err := exporter.NewUnboundExporter(*unboundHost, *unboundCa, *unboundCert, *unboundKey, log)
+	cfg := &config.Config{}
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			log.Error("Loading configuration failed", "err", err.Error())
+			os.Exit(1)
+		}
+	}
+	profiles, err := cfg.TLSCredentials(log)
 	if err != nil {
+		log.Error("Loading TLS profiles failed", "err", err.Error())
+		os.Exit(1)
+	}
+
+	// The TLS flags are only required to be valid when the default
+	// target is reached over TCP. For Unix socket and shared memory
+	// deployments they merely provide the default profile for probes, if
+	// they can be loaded.
+	defaultCreds, err := exporter.NewTLSCredentials(config.DefaultProfile, *unboundCa, *unboundCert, *unboundKey, log)
+	if err == nil {
+		profiles[config.DefaultProfile] = defaultCreds
+	} else if len(cfg.Targets) == 0 && !strings.HasPrefix(*unboundHost, "unix:") && !strings.HasPrefix(*unboundHost, "shm:") {
 		log.Error("Unbound Exporter setup failed", "err", err.Error())
 		os.Exit(1)
+	} else {
+		log.Warn("Loading the default TLS profile failed, probes of TCP targets without a profile will fail",
+			"ca", *unboundCa, "cert", *unboundCert, "key", *unboundKey, "err", err.Error())
+	}
+
+	var mapping *exporter.Mapping
+	if *mappingFile != "" {
+		mapping, err = exporter.LoadMapping(*mappingFile)
+		if err != nil {
+			log.Error("Loading metric mapping failed", "err", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	nameFilter, err := exporter.NewNameFilter(*include, *exclude)
+	if err != nil {
+		log.Error("Invalid metric name filter", "err", err.Error())
+		os.Exit(1)
+	}
+
+	var responseTimeQuantiles []float64
+	for _, q := range strings.Split(*quantiles, ",") {
+		if q == "" {
+			continue
+		}
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			log.Error("Invalid response time quantile", "quantile", q, "err", err.Error())
+			os.Exit(1)
+		}
+		responseTimeQuantiles = append(responseTimeQuantiles, quantile)
+	}
+
+	var infraOpts *exporter.InfraOptions
+	if *infra {
+		infraOpts = &exporter.InfraOptions{TopN: *infraTopN}
+		for _, zone := range strings.Split(*infraZones, ",") {
+			if zone != "" {
+				infraOpts.Zones = append(infraOpts.Zones, zone)
+			}
+		}
+	}
+
+	var requestListOpts *exporter.RequestListOptions
+	if *requestList {
+		requestListOpts = &exporter.RequestListOptions{TopN: *requestTopN}
+	}
+
+	// Probes are made on demand, so they never poll, and do not keep
+	// counter totals between requests.
+	probeOpts := exporter.Options{
+		Timeout:        *unboundTimeout,
+		LenientParsing: *lenient,
+		Status:         *status,
+		Infra:          infraOpts,
+		RequestList:    requestListOpts,
+		RateLimit:      *rateLimit,
+		AuthZones:      *authZones,
+		Unmapped:       *unmapped,
+		Mapping:        mapping,
+		Histogram:      *histogram,
+		Naming:         *naming,
+		ThreadMode:     *threadMode,
+		ZeroFill:       *zeroFill,
+		LabelLimits:    cfg.LabelLimits,
+		NameFilter:     nameFilter,
+
+		ResponseTimeQuantiles: responseTimeQuantiles,
+	}
+	opts := probeOpts
+	opts.PollInterval = *pollInterval
+	opts.AccumulateCounters = *accumulate
+	if *accumulate && *counterState != "" {
+		opts.CounterStore, err = exporter.NewCounterStore(*counterState)
+		if err != nil {
+			log.Error("Loading counter state failed", "err", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	tlsProfiles := make(map[string]*tls.Config, len(profiles))
+	var creds []*exporter.TLSCredentials
+	for name, c := range profiles {
+		tlsProfiles[name] = c.Config()
+		if c != nil {
+			creds = append(creds, c)
+		}
+	}
+
+	var exps []*exporter.UnboundExporter
+	if len(cfg.Targets) == 0 {
+		opts := opts
+		opts.TLSConfig = defaultCreds.Config()
+		exp, err := exporter.NewUnboundExporter(*unboundHost, opts, log)
+		if err != nil {
+			log.Error("Unbound Exporter setup failed", "err", err.Error())
+			os.Exit(1)
+		}
+		exps = append(exps, exp)
+	}
+	for _, target := range cfg.Targets {
+		var tlsConfig *tls.Config
+		if target.Profile != "" {
+			var ok bool
+			tlsConfig, ok = tlsProfiles[target.Profile]
+			if !ok {
+				log.Error("Unbound Exporter setup failed", "target", target.Host, "err", "TLS profile could not be loaded", "profile", target.Profile)
+				os.Exit(1)
+			}
+		} else {
+			c, err := exporter.NewTLSCredentials(target.Host, target.CA, target.Cert, target.Key, log)
+			if err != nil {
+				log.Error("Unbound Exporter setup failed", "target", target.Host, "err", err.Error())
+				os.Exit(1)
+			}
+			tlsConfig = c.Config()
+			if c != nil {
+				creds = append(creds, c)
+			}
+		}
+
+		opts := opts
+		opts.TLSConfig = tlsConfig
+		opts.ConstLabels = cfg.ConstLabels(target)
+		exp, err := exporter.NewUnboundExporter(target.Host, opts, log.With("target", target.Host))
+		if err != nil {
+			log.Error("Unbound Exporter setup failed", "target", target.Host, "err", err.Error())
+			os.Exit(1)
+		}
+		exps = append(exps, exp)
+	}
+
+	for _, exp := range exps {
+		go exp.Poll(context.Background())
+	}
+	for _, c := range creds {
+		prometheus.MustRegister(c)
 	}
+	go reloadOnSIGHUP(creds, log)
 
 	log.Info("Starting server", "address", *listenAddress)
-	err = metrics.NewMetricServer(*listenAddress, *metricsPath, *healthPath, exp)
+	err = metrics.NewMetricServer(metrics.Config{
+		ListenAddress: *listenAddress,
+		MetricsPath:   *metricsPath,
+		HealthPath:    *healthPath,
+		ProbePath:     *probePath,
+		TLSProfiles:   tlsProfiles,
+		ProbeOptions:  probeOpts,
+		TimeoutOffset: *timeoutOffset,
+	}, exps, log)
 	if err != nil {
 		log.Error("Listen failed", "err", err.Error())
 		os.Exit(1)
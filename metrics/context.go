@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/unbound_exporter/exporter"
+)
+
+// scrapeContext returns the context for the scrape triggered by r. Its
+// deadline is the scrape timeout Prometheus announces in the
+// X-Prometheus-Scrape-Timeout-Seconds header, less offset. Without the
+// header, the exporters' own timeouts apply.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return context.WithCancel(r.Context())
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+
+	timeout := time.Duration(seconds*float64(time.Second)) - offset
+	if timeout <= 0 {
+		// Better to try with the whole timeout than to fail outright.
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// scrapeFamilies returns the families of metrics selected by the collect[]
+// parameters of r, as in /metrics?collect[]=cache&collect[]=memory, or nil to
+// select all of them if there are none.
+func scrapeFamilies(r *http.Request, exps []*exporter.UnboundExporter) (exporter.Families, error) {
+	names := r.URL.Query()["collect[]"]
+	if len(names) == 0 {
+		return nil, nil
+	}
+	families := make(exporter.Families, len(names))
+	for _, name := range names {
+		known := false
+		for _, exp := range exps {
+			if slices.Contains(exp.Families(), name) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown metric family %q", name)
+		}
+		families[name] = true
+	}
+	return families, nil
+}
+
+// requestCollector collects from exporters within the context of a single
+// HTTP request, scraping all of them concurrently.
+type requestCollector struct {
+	ctx      context.Context
+	exps     []*exporter.UnboundExporter
+	families exporter.Families
+}
+
+func (c requestCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, exp := range c.exps {
+		exp.Describe(ch)
+	}
+}
+
+func (c requestCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, exp := range c.exps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exp.CollectFamilies(c.ctx, c.families, ch)
+		}()
+	}
+	wg.Wait()
+}
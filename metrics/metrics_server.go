@@ -2,13 +2,17 @@ package metrics
 
 import (
 	"bytes"
+	"crypto/tls"
 	"html/template"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/letsencrypt/unbound_exporter/config"
 	"github.com/letsencrypt/unbound_exporter/exporter"
 )
 
@@ -42,15 +46,46 @@ func homePageText(metricsPath, healthPath string) []byte {
 	return out.Bytes()
 }
 
-// NewMetricServer starts the http server on listenAddress
-func NewMetricServer(listenAddress, metricsPath, healthPath string, exp *exporter.UnboundExporter) error {
-	prometheus.MustRegister(exp)
+// allUp returns true if every exporter's last scrape succeeded.
+func allUp(exps []*exporter.UnboundExporter) bool {
+	for _, exp := range exps {
+		if !exp.UnboundUp() {
+			return false
+		}
+	}
+	return true
+}
+
+// Config holds the settings of the HTTP server.
+type Config struct {
+	ListenAddress string
+	MetricsPath   string
+	HealthPath    string
+
+	// ProbePath serves multi-target probes if not empty.
+	ProbePath string
+	// TLSProfiles are the credentials probes can select from.
+	TLSProfiles map[string]*tls.Config
+	// ProbeOptions are used for the exporters created by probes, except for
+	// their TLS configuration, which is selected by the request.
+	ProbeOptions exporter.Options
+
+	// TimeoutOffset is subtracted from the scrape timeout announced by
+	// Prometheus, to leave time to send the response.
+	TimeoutOffset time.Duration
+}
+
+// NewMetricServer starts the http server on cfg.ListenAddress, exporting
+// the metrics of exps on cfg.MetricsPath.
+func NewMetricServer(cfg Config, exps []*exporter.UnboundExporter, log *slog.Logger) error {
 	prometheus.MustRegister(version.NewCollector("unbound_exporter"))
 
-	http.Handle(metricsPath, promhttp.Handler())
+	http.Handle(cfg.MetricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		metricsHandler(exps, cfg.TimeoutOffset)))
 
-	http.HandleFunc(healthPath, func(w http.ResponseWriter, req *http.Request) {
-		if exp.UnboundUp() {
+	http.HandleFunc(cfg.HealthPath, func(w http.ResponseWriter, req *http.Request) {
+		if allUp(exps) {
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte("ok"))
 		} else {
@@ -59,10 +94,39 @@ func NewMetricServer(listenAddress, metricsPath, healthPath string, exp *exporte
 		}
 	})
 
-	renderedHomePage := homePageText(metricsPath, healthPath)
+	if cfg.ProbePath != "" {
+		http.HandleFunc(cfg.ProbePath, probeHandler(cfg.TLSProfiles, config.DefaultProfile, cfg.ProbeOptions, cfg.TimeoutOffset, log))
+	}
+
+	renderedHomePage := homePageText(cfg.MetricsPath, cfg.HealthPath)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(renderedHomePage)
 	})
 
-	return http.ListenAndServe(listenAddress, nil)
+	return http.ListenAndServe(cfg.ListenAddress, nil)
+}
+
+// metricsHandler serves the metrics of exps along with those of the default
+// registry, which holds the exporter's own Go runtime and build metrics.
+func metricsHandler(exps []*exporter.UnboundExporter, timeoutOffset time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		families, err := scrapeFamilies(r, exps)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := scrapeContext(r, timeoutOffset)
+		defer cancel()
+
+		registry := prometheus.NewRegistry()
+		err = registry.Register(requestCollector{ctx, exps, families})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		promhttp.HandlerFor(
+			prometheus.Gatherers{prometheus.DefaultGatherer, registry},
+			promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
 }
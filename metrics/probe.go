@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/letsencrypt/unbound_exporter/exporter"
+)
+
+// probeHandler scrapes the Unbound control socket named by the target query
+// parameter, e.g. /probe?target=tcp://10.0.0.5:8953&profile=edge. The profile
+// parameter selects one of tlsProfiles and defaults to defaultProfile, except
+// for unix: and shm: targets, which need none. collect[] parameters select
+// families of metrics as on the metrics path. Each request gets its own
+// exporter and registry, so no state is shared between targets.
+func probeHandler(tlsProfiles map[string]*tls.Config, defaultProfile string, opts exporter.Options, timeoutOffset time.Duration, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		// Unix sockets and shared memory need no TLS, so they do not
+		// need the default profile, which may not exist.
+		profile := r.URL.Query().Get("profile")
+		local := strings.HasPrefix(target, "unix:") || strings.HasPrefix(target, "shm:")
+		if profile == "" && !local {
+			profile = defaultProfile
+		}
+		var tlsConfig *tls.Config
+		if profile != "" {
+			var ok bool
+			tlsConfig, ok = tlsProfiles[profile]
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown tls profile %q", profile), http.StatusBadRequest)
+				return
+			}
+		}
+
+		targetOpts := opts
+		targetOpts.TLSConfig = tlsConfig
+		exp, err := exporter.NewUnboundExporter(target, targetOpts, log.With("target", target))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid target %q: %s", target, err), http.StatusBadRequest)
+			return
+		}
+		exps := []*exporter.UnboundExporter{exp}
+		families, err := scrapeFamilies(r, exps)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := scrapeContext(r, timeoutOffset)
+		defer cancel()
+
+		registry := prometheus.NewRegistry()
+		err = registry.Register(requestCollector{ctx, exps, families})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+
+	"github.com/letsencrypt/unbound_exporter/exporter"
+	"github.com/letsencrypt/unbound_exporter/internal/unboundtest"
+)
+
+func TestProbe(t *testing.T) {
+	handler := probeHandler(map[string]*tls.Config{"default": nil}, "default", exporter.Options{}, 0, promslog.NewNopLogger())
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"", http.StatusBadRequest, "target parameter is missing"},
+		{"target=tcp://", http.StatusBadRequest, "invalid target"},
+		{"target=tcp://127.0.0.1:8953&profile=missing", http.StatusBadRequest, "unknown tls profile"},
+		{"target=" + target, http.StatusOK, "unbound_up 1"},
+		{"target=" + target + "&collect[]=memory", http.StatusOK, "unbound_memory_caches_bytes"},
+		{"target=" + target + "&collect[]=bogus", http.StatusBadRequest, "unknown metric family"},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/probe?"+tc.query, nil))
+		body, _ := io.ReadAll(rec.Body)
+		if rec.Code != tc.code {
+			t.Errorf("%q: expected status %d, got %d", tc.query, tc.code, rec.Code)
+		}
+		if !strings.Contains(string(body), tc.body) {
+			t.Errorf("%q: expected body to contain %q, got %q", tc.query, tc.body, body)
+		}
+	}
+}
+
+func TestProbeWithoutDefaultProfile(t *testing.T) {
+	// The TLS flags did not load, as in a Unix socket deployment.
+	handler := probeHandler(map[string]*tls.Config{}, "default", exporter.Options{}, 0, promslog.NewNopLogger())
+	target := unboundtest.Listen(t, unboundtest.Commands(t, nil))
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"target=" + target, http.StatusOK, "unbound_up 1"},
+		{"target=" + target + "&profile=missing", http.StatusBadRequest, "unknown tls profile"},
+		{"target=tcp://127.0.0.1:8953", http.StatusBadRequest, "unknown tls profile"},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/probe?"+tc.query, nil))
+		body, _ := io.ReadAll(rec.Body)
+		if rec.Code != tc.code {
+			t.Errorf("%q: expected status %d, got %d", tc.query, tc.code, rec.Code)
+		}
+		if !strings.Contains(string(body), tc.body) {
+			t.Errorf("%q: expected body to contain %q, got %q", tc.query, tc.body, body)
+		}
+	}
+}
+
+func TestScrapeContext(t *testing.T) {
+	for header, expected := range map[string]time.Duration{
+		"":      0,
+		"bogus": 0,
+		"10":    9500 * time.Millisecond,
+		"0.2":   200 * time.Millisecond,
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", header)
+		}
+		ctx, cancel := scrapeContext(r, 500*time.Millisecond)
+		deadline, ok := ctx.Deadline()
+		cancel()
+
+		if expected == 0 {
+			if ok {
+				t.Errorf("%q: expected no deadline", header)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%q: expected a deadline", header)
+			continue
+		}
+		if remaining := time.Until(deadline); remaining > expected || remaining < expected-time.Second {
+			t.Errorf("%q: expected a deadline in %s, got %s", header, expected, remaining)
+		}
+	}
+}